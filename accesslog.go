@@ -0,0 +1,243 @@
+package socks
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// AccessRecord describes a finished session.
+type AccessRecord struct {
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration_ns"`
+	Session  uint64        `json:"session"`
+	Client   string        `json:"client"`
+	User     string        `json:"user,omitempty"`
+	Command  Command       `json:"command"`
+	// Target is the requested host:port, Remote the address connected to
+	Target string `json:"target,omitempty"`
+	Remote string `json:"remote,omitempty"`
+	// Reply is the reply code sent to the request, -1 if there was none
+	Reply    int    `json:"reply"`
+	Upload   int64  `json:"upload"`
+	Download int64  `json:"download"`
+	Reason   string `json:"reason"`
+}
+
+// AccessLog receives one record per session when it ends.
+type AccessLog interface {
+	Log(r *AccessRecord)
+}
+
+// DefaultAccessLogFormat is a text format in the spirit of web server access logs.
+const DefaultAccessLogFormat = `{{.Start.Format "2006-01-02T15:04:05.000Z07:00"}} {{.Session}} {{.Client}} {{or .User "-"}} ` +
+	`{{.Command}} {{or .Target "-"}} {{or .Remote "-"}} {{.Reply}} {{.Upload}} {{.Download}} {{.Duration}} {{printf "%q" .Reason}}`
+
+// AccessLogger writes access records to w, as JSON lines if format
+// is "json", otherwise one line per record rendered by the format
+// text/template, which is given the *AccessRecord.
+type AccessLogger struct {
+	mu   sync.Mutex
+	w    io.Writer
+	tmpl *template.Template
+}
+
+func NewAccessLogger(w io.Writer, format string) (*AccessLogger, error) {
+	l := &AccessLogger{w: w}
+	if format == "json" {
+		return l, nil
+	}
+	tmpl, err := template.New("access").Parse(strings.TrimSuffix(format, "\n") + "\n")
+	if err != nil {
+		return nil, err
+	}
+	l.tmpl = tmpl
+	return l, nil
+}
+
+func (l *AccessLogger) Log(r *AccessRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.tmpl == nil {
+		json.NewEncoder(l.w).Encode(r)
+		return
+	}
+	l.tmpl.Execute(l.w, r)
+}
+
+// accessRecord returns the record of the session ended by err.
+func (sess *session) accessRecord(err error) *AccessRecord {
+	r := &AccessRecord{
+		Start:    sess.start,
+		Duration: time.Since(sess.start),
+		Session:  sess.id,
+		Client:   sess.client.String(),
+		User:     sess.user,
+		Target:   sess.target(),
+		Reply:    -1,
+		Upload:   sess.stats.Upload,
+		Download: sess.stats.Download,
+		Reason:   "closed",
+	}
+	if sess.request != nil {
+		r.Command = sess.request.Command
+	}
+	if sess.remote != nil {
+		r.Remote = sess.remote.String()
+	}
+	if sess.replied {
+		r.Reply = int(sess.reply)
+	}
+	if err != nil {
+		r.Reason = err.Error()
+	}
+	return r
+}
+
+// rotationSuffix is the time layout of the suffix of rotated files.
+const rotationSuffix = "20060102T150405.000000000"
+
+// RotatingFile is a log file which is rotated once it grows over
+// MaxSize bytes or is older than MaxAge. Rotated files are renamed
+// with a timestamp suffix, only the newest MaxBackups are kept.
+// Zero values disable the respective limit.
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxAge     time.Duration
+	MaxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	// since is when the file was started, its modification time
+	// if it was written before it was opened
+	since time.Time
+
+	now func() time.Time
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.size > 0 && f.due(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Rotate starts a new file, for example on a signal from logrotate.
+func (f *RotatingFile) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rotate()
+}
+
+// SetLimits changes the rotation limits of a file in use.
+func (f *RotatingFile) SetLimits(maxSize int64, maxAge time.Duration, maxBackups int) {
+	f.mu.Lock()
+	f.MaxSize, f.MaxAge, f.MaxBackups = maxSize, maxAge, maxBackups
+	f.mu.Unlock()
+}
+
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *RotatingFile) due(n int64) bool {
+	if f.MaxSize > 0 && f.size+n > f.MaxSize {
+		return true
+	}
+	return f.MaxAge > 0 && f.clock().Sub(f.since) >= f.MaxAge
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	f.since = f.clock()
+	if f.size > 0 && info.ModTime().Before(f.since) {
+		f.since = info.ModTime()
+	}
+	return nil
+}
+
+func (f *RotatingFile) rotate() error {
+	if f.file != nil {
+		if err := f.file.Close(); err != nil {
+			return err
+		}
+		f.file = nil
+	}
+	backup := fmt.Sprintf("%s.%s", f.Path, f.clock().Format(rotationSuffix))
+	if err := os.Rename(f.Path, backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := f.prune(); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *RotatingFile) prune() error {
+	if f.MaxBackups <= 0 {
+		return nil
+	}
+	matches, err := filepath.Glob(f.Path + ".*")
+	if err != nil {
+		return err
+	}
+	// Leave alone files which weren't rotated by us
+	var backups []string
+	for _, match := range matches {
+		if _, err := time.Parse(rotationSuffix, strings.TrimPrefix(match, f.Path+".")); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	// Timestamps sort chronologically
+	sort.Strings(backups)
+	for len(backups) > f.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+func (f *RotatingFile) clock() time.Time {
+	if f.now != nil {
+		return f.now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,188 @@
+package socks
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAccessLogger(t *testing.T) {
+	record := &AccessRecord{
+		Start:    time.Date(2026, 10, 19, 8, 30, 0, 0, time.UTC),
+		Duration: 1500 * time.Millisecond,
+		Session:  7,
+		Client:   "127.0.0.1:50000",
+		User:     "admin",
+		Command:  CmdConnect,
+		Target:   "example.com:443",
+		Remote:   "93.184.216.34:443",
+		Reply:    int(ReplySucceeded),
+		Upload:   100,
+		Download: 2000,
+		Reason:   "closed",
+	}
+
+	cases := []struct {
+		name   string
+		format string
+		expect string
+	}{
+		{
+			name:   "json",
+			format: "json",
+			expect: `{"start":"2026-10-19T08:30:00Z","duration_ns":1500000000,"session":7,"client":"127.0.0.1:50000","user":"admin","command":1,"target":"example.com:443","remote":"93.184.216.34:443","reply":0,"upload":100,"download":2000,"reason":"closed"}` + "\n",
+		},
+		{
+			name:   "default_text",
+			format: DefaultAccessLogFormat,
+			expect: `2026-10-19T08:30:00.000Z 7 127.0.0.1:50000 admin 1 example.com:443 93.184.216.34:443 0 100 2000 1.5s "closed"` + "\n",
+		},
+		{
+			name:   "custom_text",
+			format: "{{.User}} -> {{.Target}}",
+			expect: "admin -> example.com:443\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			l, err := NewAccessLogger(&buf, c.format)
+			if err != nil {
+				t.Fatalf("expected want nil but got error: %+v", err)
+			}
+			l.Log(record)
+			if got := buf.String(); got != c.expect {
+				t.Fatalf("expected record %q but got %q", c.expect, got)
+			}
+		})
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	cases := []struct {
+		name        string
+		maxSize     int64
+		maxAge      time.Duration
+		maxBackups  int
+		writes      int
+		elapsed     time.Duration
+		wantBackups int
+	}{
+		{
+			name:        "size",
+			maxSize:     25,
+			writes:      5,
+			wantBackups: 2,
+		},
+		{
+			name:        "size_max_backups",
+			maxSize:     10,
+			maxBackups:  1,
+			writes:      5,
+			wantBackups: 1,
+		},
+		{
+			name:        "age",
+			maxAge:      time.Hour,
+			writes:      3,
+			elapsed:     time.Hour,
+			wantBackups: 2,
+		},
+		{
+			name:        "no_rotation",
+			writes:      5,
+			wantBackups: 0,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "access.log")
+			now := time.Now()
+			f := &RotatingFile{
+				Path:       path,
+				MaxSize:    c.maxSize,
+				MaxAge:     c.maxAge,
+				MaxBackups: c.maxBackups,
+				now:        func() time.Time { return now },
+			}
+			defer f.Close()
+
+			for i := 0; i < c.writes; i++ {
+				if _, err := f.Write([]byte("record 10\n")); err != nil {
+					t.Fatalf("expected want nil but got error: %+v", err)
+				}
+				now = now.Add(c.elapsed + time.Millisecond)
+			}
+
+			backups, _ := filepath.Glob(path + ".*")
+			if len(backups) != c.wantBackups {
+				t.Fatalf("expected %v backups but got %v", c.wantBackups, backups)
+			}
+			if _, err := os.Stat(path); err != nil {
+				t.Fatalf("expected current file but got error: %+v", err)
+			}
+		})
+	}
+}
+
+func TestRotatingFileSetLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f := &RotatingFile{Path: path}
+	defer f.Close()
+	f.Write([]byte("first\n"))
+	f.SetLimits(8, 0, 0)
+	f.Write([]byte("second\n"))
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 1 {
+		t.Fatalf("expected %v rotated file but got %v", 1, backups)
+	}
+}
+
+func TestRotatingFilePrune(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	others := []string{path + ".keep", path + ".20060102", path + ".gz"}
+	for _, other := range others {
+		os.WriteFile(other, nil, 0o644)
+	}
+	now := time.Now()
+	f := &RotatingFile{Path: path, MaxSize: 10, MaxBackups: 1, now: func() time.Time { return now }}
+	defer f.Close()
+	for i := 0; i < 5; i++ {
+		f.Write([]byte("record 10\n"))
+		now = now.Add(time.Millisecond)
+	}
+
+	// Only rotated files count as backups
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != len(others)+1 {
+		t.Fatalf("expected %v files besides the current one but got %v", len(others)+1, backups)
+	}
+	for _, other := range others {
+		if _, err := os.Stat(other); err != nil {
+			t.Fatalf("expected %v kept but got error: %+v", other, err)
+		}
+	}
+}
+
+func TestRotatingFileMaxAgeExisting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	os.WriteFile(path, []byte("old record\n"), 0o644)
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(path, old, old)
+
+	// A file written before a restart is as old as its last write
+	f := &RotatingFile{Path: path, MaxAge: time.Hour}
+	defer f.Close()
+	f.Write([]byte("record 10\n"))
+	f.Write([]byte("record 10\n"))
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 1 {
+		t.Fatalf("expected %v rotated file but got %v", 1, backups)
+	}
+}
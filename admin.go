@@ -0,0 +1,250 @@
+package socks
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const defaultAdminAddr = "127.0.0.1:1090"
+
+// Admin configures the admin HTTP API. Requests must carry the token
+// in an "Authorization: Bearer <token>" header. The API serves:
+//
+//	GET    /sessions[?user=name]  list sessions, optionally of one user
+//	DELETE /sessions/<id>         close a session
+//	DELETE /sessions?user=name    close all sessions of a user
+//	POST   /reload                call Reload
+//	GET    /drain                 report whether the server is draining
+//	POST   /drain                 start draining
+//	DELETE /drain                 stop draining
+type Admin struct {
+	// Addr is the listen address, default 127.0.0.1:1090. An address
+	// without host, such as ":1090", binds to 127.0.0.1 too.
+	Addr string
+
+	// Token authenticates API requests. It must be set.
+	Token string
+
+	// Reload is called by POST /reload to reload the configuration.
+	// The endpoint answers 501 Not Implemented if nil.
+	Reload func() error
+}
+
+func (a *Admin) validate() error {
+	if a != nil && a.Token == "" {
+		return ErrAdminTokenNotSet
+	}
+	return nil
+}
+
+func (a *Admin) addr() string {
+	if a.Addr == "" {
+		return defaultAdminAddr
+	}
+	host, port, err := net.SplitHostPort(a.Addr)
+	if err == nil && host == "" {
+		return net.JoinHostPort("127.0.0.1", port)
+	}
+	return a.Addr
+}
+
+// Sessions returns the sessions currently open, ordered by ID.
+func (s *Server) Sessions() []SessionInfo {
+	s.mu.Lock()
+	infos := make([]SessionInfo, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		infos = append(infos, sess.snapshot())
+	}
+	s.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// CloseSession closes the session with the given ID and reports
+// whether it was open.
+func (s *Server) CloseSession(id uint64) bool {
+	s.mu.Lock()
+	sess, ok := s.sessions[id]
+	s.mu.Unlock()
+	if ok {
+		sess.close()
+	}
+	return ok
+}
+
+// CloseUserSessions closes every session of user and returns their number.
+func (s *Server) CloseUserSessions(user string) int {
+	var closing []*session
+	s.mu.Lock()
+	for _, sess := range s.sessions {
+		if sess.snapshot().User == user {
+			closing = append(closing, sess)
+		}
+	}
+	s.mu.Unlock()
+	for _, sess := range closing {
+		sess.close()
+	}
+	return len(closing)
+}
+
+// SetDraining toggles drain mode. While draining, new sessions are
+// refused with ReplyGeneralSOCKSServerFailure and open sessions go on.
+func (s *Server) SetDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	atomic.StoreInt32(&s.draining, v)
+}
+
+// Draining reports whether the server is in drain mode.
+func (s *Server) Draining() bool {
+	return atomic.LoadInt32(&s.draining) != 0
+}
+
+func (s *Server) track(sess *session) {
+	s.mu.Lock()
+	if s.sessions == nil {
+		s.sessions = make(map[uint64]*session)
+	}
+	s.sessions[sess.id] = sess
+	s.mu.Unlock()
+}
+
+func (s *Server) untrack(sess *session) {
+	s.mu.Lock()
+	delete(s.sessions, sess.id)
+	s.mu.Unlock()
+}
+
+func (s *Server) serveAdmin(admin *Admin, logger Logger) {
+	s.serveHTTP("admin", admin.addr(), s.adminHandler(admin), logger)
+}
+
+// adminSession is the JSON form of a SessionInfo.
+type adminSession struct {
+	ID       uint64    `json:"id"`
+	Client   string    `json:"client"`
+	User     string    `json:"user,omitempty"`
+	Target   string    `json:"target,omitempty"`
+	Remote   string    `json:"remote,omitempty"`
+	Start    time.Time `json:"start"`
+	Upload   int64     `json:"upload_bytes"`
+	Download int64     `json:"download_bytes"`
+}
+
+func (s *Server) adminHandler(admin *Admin) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		user := r.URL.Query().Get("user")
+		switch r.Method {
+		case http.MethodGet:
+			sessions := []adminSession{}
+			for _, info := range s.Sessions() {
+				if user != "" && info.User != user {
+					continue
+				}
+				sessions = append(sessions, newAdminSession(info))
+			}
+			writeJSON(w, sessions)
+		case http.MethodDelete:
+			if user == "" {
+				http.Error(w, "user parameter required", http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, map[string]int{"closed": s.CloseUserSessions(user)})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/sessions/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/sessions/"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid session id", http.StatusBadRequest)
+			return
+		}
+		if !s.CloseSession(id) {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, map[string]int{"closed": 1})
+	})
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if admin.Reload == nil {
+			http.Error(w, "reload not supported", http.StatusNotImplemented)
+			return
+		}
+		if err := admin.Reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		writeJSON(w, map[string]bool{"reloaded": true})
+	})
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			s.SetDraining(true)
+		case http.MethodDelete:
+			s.SetDraining(false)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, map[string]bool{"draining": s.Draining()})
+	})
+	return adminAuth(admin.Token, mux)
+}
+
+// adminAuth rejects requests without the bearer token.
+func adminAuth(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		got := strings.TrimPrefix(header, "Bearer ")
+		if token == "" || got == header || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func newAdminSession(info SessionInfo) adminSession {
+	a := adminSession{
+		ID:       info.ID,
+		User:     info.User,
+		Target:   info.Target,
+		Start:    info.Start,
+		Upload:   info.Upload,
+		Download: info.Download,
+	}
+	if info.Client != nil {
+		a.Client = info.Client.String()
+	}
+	if info.Remote != nil {
+		a.Remote = info.Remote.String()
+	}
+	return a
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
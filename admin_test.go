@@ -0,0 +1,180 @@
+package socks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminRequest(h http.Handler, method, target, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminAuth(t *testing.T) {
+	h := adminAuth("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	cases := []struct {
+		header string
+		code   int
+	}{
+		{"", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Basic secret", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+		r.Header.Set("Authorization", c.header)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Fatalf("expected %q to answer %v but got %v", c.header, c.code, w.Code)
+		}
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	closed := make(chan error, 1)
+	conf := *testPasswordConf
+	conf.Hooks.OnClose = func(ctx context.Context, info SessionInfo, stats RelayStats, err error) {
+		closed <- err
+	}
+	s := new(Server)
+	go s.serveConn(server, &conf)
+
+	// authenticate and leave the session waiting for the request
+	handshake := testHandshake("")
+	go client.Write(handshake[:3+2+5+1+6])
+	if _, err := io.ReadFull(client, make([]byte, 4)); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	for i := 0; len(s.Sessions()) == 0 || s.Sessions()[0].User == ""; i++ {
+		if i == 100 {
+			t.Fatalf("expected an authenticated session but got %+v", s.Sessions())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	reloaded := false
+	h := s.adminHandler(&Admin{Token: "secret", Reload: func() error {
+		reloaded = true
+		return nil
+	}})
+	cases := []struct {
+		method string
+		target string
+		token  string
+		code   int
+		body   string
+	}{
+		{http.MethodGet, "/sessions", "", http.StatusUnauthorized, "unauthorized\n"},
+		{http.MethodGet, "/sessions", "wrong", http.StatusUnauthorized, "unauthorized\n"},
+		{http.MethodGet, "/sessions?user=other", "secret", http.StatusOK, "[]\n"},
+		{http.MethodGet, "/drain", "secret", http.StatusOK, `{"draining":false}` + "\n"},
+		{http.MethodPost, "/drain", "secret", http.StatusOK, `{"draining":true}` + "\n"},
+		{http.MethodPost, "/reload", "secret", http.StatusOK, `{"reloaded":true}` + "\n"},
+		{http.MethodDelete, "/sessions", "secret", http.StatusBadRequest, "user parameter required\n"},
+		{http.MethodDelete, "/sessions/x", "secret", http.StatusBadRequest, "invalid session id\n"},
+		{http.MethodDelete, "/sessions/2", "secret", http.StatusNotFound, "session not found\n"},
+		{http.MethodPut, "/reload", "secret", http.StatusMethodNotAllowed, "method not allowed\n"},
+	}
+	for _, c := range cases {
+		w := adminRequest(h, c.method, c.target, c.token)
+		if w.Code != c.code || w.Body.String() != c.body {
+			t.Fatalf("expected %v %v to answer %v %q but got %v %q", c.method, c.target, c.code, c.body, w.Code, w.Body.String())
+		}
+	}
+	if !reloaded || !s.Draining() {
+		t.Fatalf("expected reload and drain mode but got %v and %v", reloaded, s.Draining())
+	}
+
+	w := adminRequest(h, http.MethodGet, "/sessions?user=admin", "secret")
+	var sessions []adminSession
+	if err := json.NewDecoder(w.Body).Decode(&sessions); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != 1 || sessions[0].User != "admin" || sessions[0].Client != "pipe" {
+		t.Fatalf("expected session %v of %v but got %+v", 1, "admin", sessions)
+	}
+
+	w = adminRequest(h, http.MethodDelete, "/sessions?user=admin", "secret")
+	if body := w.Body.String(); body != `{"closed":1}`+"\n" {
+		t.Fatalf("expected %q but got %q", `{"closed":1}`, body)
+	}
+	if err := <-closed; err != ErrSessionClosed {
+		t.Fatalf("expected want error %v but got %v", ErrSessionClosed, err)
+	}
+	for i := 0; len(s.Sessions()) != 0; i++ {
+		if i == 100 {
+			t.Fatalf("expected %v sessions but got %v", 0, len(s.Sessions()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAdminReloadFailure(t *testing.T) {
+	h := new(Server).adminHandler(&Admin{Token: "secret", Reload: func() error {
+		return errors.New("invalid config")
+	}})
+	w := adminRequest(h, http.MethodPost, "/reload", "secret")
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "invalid config") {
+		t.Fatalf("expected %v with the reload error but got %v %q", http.StatusUnprocessableEntity, w.Code, w.Body.String())
+	}
+}
+
+func TestAdminAddr(t *testing.T) {
+	cases := map[string]string{
+		"":               defaultAdminAddr,
+		":8080":          "127.0.0.1:8080",
+		"0.0.0.0:8080":   "0.0.0.0:8080",
+		"localhost:8080": "localhost:8080",
+	}
+	for addr, expect := range cases {
+		if got := (&Admin{Addr: addr}).addr(); got != expect {
+			t.Fatalf("expected %q to listen on %v but got %v", addr, expect, got)
+		}
+	}
+	if err := (&Admin{}).validate(); err != ErrAdminTokenNotSet {
+		t.Fatalf("expected want error %v but got %v", ErrAdminTokenNotSet, err)
+	}
+}
+
+func TestServerDraining(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	s := new(Server)
+	s.SetDraining(true)
+	errc := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		errc <- s.handleConn(newSession(1, server), &Config{})
+	}()
+	go client.Write([]byte{SOCKS5Version, 1, MethodNoAuth, SOCKS5Version, CmdConnect, ReservedField, IPv4Addr, 127, 0, 0, 1, 0, 80})
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	if reply[3] != ReplyGeneralSOCKSServerFailure {
+		t.Fatalf("expected reply %v but got %v", ReplyGeneralSOCKSServerFailure, reply[3])
+	}
+	if err := <-errc; err != ErrServerDraining {
+		t.Fatalf("expected want error %v but got %v", ErrServerDraining, err)
+	}
+}
@@ -42,22 +42,31 @@ const (
 // The client connects to the server, and sends a version
 // identifier/method selection message:
 //
-//         +----+----------+----------+
-//         |VER | NMETHODS | METHODS  |
-//         +----+----------+----------+
-//         | 1  |    1     | 1 to 255 |
-//         +----+----------+----------+
+//	+----+----------+----------+
+//	|VER | NMETHODS | METHODS  |
+//	+----+----------+----------+
+//	| 1  |    1     | 1 to 255 |
+//	+----+----------+----------+
 func NewClientAuthMsg(conn io.Reader) (*ClientAuthMsg, error) {
+	var msg ClientAuthMsg
+	if err := readClientAuthMsg(conn, make([]byte, 255), &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// readClientAuthMsg parses the message into msg without allocating,
+// msg.Methods aliases buf which must hold 255 bytes.
+func readClientAuthMsg(conn io.Reader, buf []byte, msg *ClientAuthMsg) error {
 	// Read Version and NMethods
-	buf := make([]byte, 2)
-	_, err := io.ReadFull(conn, buf)
+	_, err := io.ReadFull(conn, buf[:2])
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Validate version
 	if buf[0] != SOCKS5Version {
-		return nil, ErrVersionNotSupported
+		return ErrVersionNotSupported
 	}
 
 	// Read Methods
@@ -66,85 +75,100 @@ func NewClientAuthMsg(conn io.Reader) (*ClientAuthMsg, error) {
 	// uint8 is the set of all unsigned 8-bit integers. Range: 0 through 255.
 	nmethods := buf[1]
 	if nmethods == 0 {
-		return nil, ErrMethodsLengthZero
+		return ErrMethodsLengthZero
 	}
-	buf = make([]byte, nmethods)
-	_, err = io.ReadFull(conn, buf)
+	_, err = io.ReadFull(conn, buf[:nmethods])
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &ClientAuthMsg{
-		Version:  SOCKS5Version,
-		NMethods: nmethods,
-		Methods:  buf,
-	}, nil
+	msg.Version = SOCKS5Version
+	msg.NMethods = nmethods
+	msg.Methods = buf[:nmethods]
+	return nil
 }
 
 func NewServerAuthMsg(conn io.Writer, method Method) error {
-	buf := []byte{SOCKS5Version, method}
-	_, err := conn.Write(buf)
+	_, err := conn.Write(appendServerAuthMsg(nil, method))
 	return err
 }
 
+func appendServerAuthMsg(b []byte, method Method) []byte {
+	return append(b, SOCKS5Version, method)
+}
+
 // Once the SOCKS V5 server has started, and the client has selected the
 // Username/Password Authentication protocol, the Username/Password
 // subnegotiation begins.  This begins with the client producing a
 // Username/Password request:
 //
-//         +----+------+----------+------+----------+
-//         |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
-//         +----+------+----------+------+----------+
-//         | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
-//         +----+------+----------+------+----------+
+//	+----+------+----------+------+----------+
+//	|VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+//	+----+------+----------+------+----------+
+//	| 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+//	+----+------+----------+------+----------+
 func NewClientPasswordMsg(conn io.Reader) (*ClientPasswordMsg, error) {
+	var msg ClientPasswordMsg
+	if err := readClientPasswordMsg(conn, make([]byte, 255), &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// readClientPasswordMsg parses the message into msg, buf must hold 255 bytes.
+func readClientPasswordMsg(conn io.Reader, buf []byte, msg *ClientPasswordMsg) error {
 	// Read version and username length
-	buf := make([]byte, 2)
-	_, err := io.ReadFull(conn, buf)
+	_, err := io.ReadFull(conn, buf[:2])
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	version, usernameLen := buf[0], buf[1]
 	if version != PasswordMethodVersion {
-		return nil, ErrMethodVersionNotSupported
+		return ErrMethodVersionNotSupported
 	}
 
 	// UNAME 1 to 255
 	// uint8 is the set of all unsigned 8-bit integers. Range: 0 through 255.
 	if usernameLen == 0 {
-		return nil, ErrUsernameLengthZero
+		return ErrUsernameLengthZero
 	}
 
-	// Read username, password
-	buf = make([]byte, int(usernameLen)+1)
-	_, err = io.ReadFull(conn, buf)
+	// Read username
+	_, err = io.ReadFull(conn, buf[:usernameLen])
 	if err != nil {
-		return nil, err
+		return err
+	}
+	username := string(buf[:usernameLen])
+
+	// Read password length
+	_, err = io.ReadFull(conn, buf[:1])
+	if err != nil {
+		return err
 	}
-	username, passwordLen := string(buf[:len(buf)-1]), buf[len(buf)-1]
+	passwordLen := buf[0]
 
 	// PASSWD 1 to 255
 	// uint8 is the set of all unsigned 8-bit integers. Range: 0 through 255.
 	if passwordLen == 0 {
-		return nil, ErrPasswordLengthZero
+		return ErrPasswordLengthZero
 	}
 
 	// Read password
-	if len(buf) < int(passwordLen) {
-		buf = make([]byte, passwordLen)
-	}
 	_, err = io.ReadFull(conn, buf[:passwordLen])
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return &ClientPasswordMsg{
-		Username: username,
-		Password: string(buf[:passwordLen]),
-	}, nil
+	msg.Username = username
+	msg.Password = string(buf[:passwordLen])
+	return nil
 }
 
 func WriteSrvPasswordMsg(conn io.Writer, status byte) error {
-	_, err := conn.Write([]byte{PasswordMethodVersion, status})
+	_, err := conn.Write(appendSrvPasswordMsg(nil, status))
 	return err
 }
+
+func appendSrvPasswordMsg(b []byte, status byte) []byte {
+	return append(b, PasswordMethodVersion, status)
+}
@@ -0,0 +1,244 @@
+package socks
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Bandwidth is a token bucket rate limit.
+type Bandwidth struct {
+	// Rate in bytes per second, zero means unlimited.
+	Rate int64
+	// Burst is the bucket size in bytes, Rate if zero.
+	Burst int64
+}
+
+// Throttle limits the upload (client to target) and
+// download (target to client) directions independently.
+type Throttle struct {
+	Upload   Bandwidth
+	Download Bandwidth
+}
+
+// BandwidthLimits configures throttling of tunnel traffic. A tunnel is
+// throttled by the global, its user's and its own limits at once.
+type BandwidthLimits struct {
+	// Global is shared by all tunnels.
+	Global Throttle
+	// PerUser is shared by the tunnels of each user, Users overrides it.
+	PerUser Throttle
+	Users   map[string]Throttle
+	// PerConn applies to every tunnel on its own.
+	PerConn Throttle
+}
+
+func (l *BandwidthLimits) user(user string) Throttle {
+	if t, ok := l.Users[user]; ok {
+		return t
+	}
+	return l.PerUser
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bw Bandwidth) *tokenBucket {
+	b := new(tokenBucket)
+	b.setLimit(bw)
+	return b
+}
+
+func (b *tokenBucket) setLimit(bw Bandwidth) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if b.rate > 0 {
+		b.refill(now)
+	}
+	unlimited := b.rate <= 0
+	b.rate = float64(bw.Rate)
+	b.burst = float64(bw.Burst)
+	if b.burst <= 0 {
+		b.burst = b.rate
+	}
+	if unlimited || b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	// Debt run up under a higher limit shouldn't stall the bucket for long
+	if b.tokens < -b.burst {
+		b.tokens = -b.burst
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// reserve takes n tokens, going into debt if there aren't enough,
+// and returns how long to wait until the debt is paid.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// chunk returns the largest transfer which should be made at once, 0 if unlimited.
+func (b *tokenBucket) chunk() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	return int(b.burst)
+}
+
+type bucketPair struct {
+	up, down *tokenBucket
+}
+
+func newBucketPair(t Throttle) bucketPair {
+	return bucketPair{newTokenBucket(t.Upload), newTokenBucket(t.Download)}
+}
+
+func (p bucketPair) setLimit(t Throttle) {
+	p.up.setLimit(t.Upload)
+	p.down.setLimit(t.Download)
+}
+
+type userBuckets struct {
+	bucketPair
+	refs int
+}
+
+// bandwidthLimiter holds the token buckets of the live tunnels so the
+// limits can be changed without dropping them. The zero value is unlimited.
+type bandwidthLimiter struct {
+	mu     sync.Mutex
+	limits BandwidthLimits
+	global *bucketPair
+	users  map[string]*userBuckets
+	conns  map[*tunnelBandwidth]struct{}
+}
+
+// tunnelBandwidth is the set of buckets throttling one tunnel.
+type tunnelBandwidth struct {
+	up, down []*tokenBucket
+
+	limiter *bandwidthLimiter
+	user    string
+	conn    bucketPair
+}
+
+func (l *bandwidthLimiter) set(limits BandwidthLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+	if l.global != nil {
+		l.global.setLimit(limits.Global)
+	}
+	for user, b := range l.users {
+		b.setLimit(limits.user(user))
+	}
+	for t := range l.conns {
+		t.conn.setLimit(limits.PerConn)
+	}
+}
+
+// open returns the buckets of a new tunnel of user. It must be closed.
+func (l *bandwidthLimiter) open(user string) *tunnelBandwidth {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.global == nil {
+		global := newBucketPair(l.limits.Global)
+		l.global = &global
+	}
+	t := &tunnelBandwidth{
+		limiter: l,
+		user:    user,
+		conn:    newBucketPair(l.limits.PerConn),
+	}
+	t.up = append(t.up, l.global.up, t.conn.up)
+	t.down = append(t.down, l.global.down, t.conn.down)
+	if user != "" {
+		if l.users == nil {
+			l.users = make(map[string]*userBuckets)
+		}
+		b, ok := l.users[user]
+		if !ok {
+			b = &userBuckets{bucketPair: newBucketPair(l.limits.user(user))}
+			l.users[user] = b
+		}
+		b.refs++
+		t.up = append(t.up, b.up)
+		t.down = append(t.down, b.down)
+	}
+	if l.conns == nil {
+		l.conns = make(map[*tunnelBandwidth]struct{})
+	}
+	l.conns[t] = struct{}{}
+	return t
+}
+
+func (t *tunnelBandwidth) close() {
+	l := t.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.conns, t)
+	if b, ok := l.users[t.user]; ok {
+		if b.refs--; b.refs == 0 {
+			delete(l.users, t.user)
+		}
+	}
+}
+
+// SetBandwidth changes the bandwidth limits of new and live tunnels.
+func (s *Server) SetBandwidth(limits BandwidthLimits) {
+	s.bandwidth.set(limits)
+}
+
+// throttle blocks until all buckets allow a transfer of n bytes. It
+// returns early when the tunnel ends or its lifetime is exceeded.
+func (t *tunnel) throttle(buckets []*tokenBucket, n int64) error {
+	var wait time.Duration
+	for _, b := range buckets {
+		if d := b.reserve(int(n)); d > wait {
+			wait = d
+		}
+	}
+	if wait <= 0 {
+		return nil
+	}
+	var err error
+	if expires := t.timeouts.expires; !expires.IsZero() && time.Until(expires) < wait {
+		wait, err = time.Until(expires), ErrSessionLifetimeExceeded
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return err
+	case <-t.done:
+		return net.ErrClosed
+	case <-t.aborted:
+		return net.ErrClosed
+	}
+}
@@ -0,0 +1,150 @@
+package socks
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	cases := []struct {
+		name     string
+		bw       Bandwidth
+		reserve  []int
+		wantWait bool
+	}{
+		{
+			name:     "unlimited",
+			bw:       Bandwidth{},
+			reserve:  []int{1 << 30},
+			wantWait: false,
+		},
+		{
+			name:     "within_burst",
+			bw:       Bandwidth{Rate: 1000, Burst: 2000},
+			reserve:  []int{1000, 1000},
+			wantWait: false,
+		},
+		{
+			name:     "over_burst",
+			bw:       Bandwidth{Rate: 1000, Burst: 2000},
+			reserve:  []int{1000, 1000, 1000},
+			wantWait: true,
+		},
+		{
+			name:     "default_burst",
+			bw:       Bandwidth{Rate: 1000},
+			reserve:  []int{1001},
+			wantWait: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := newTokenBucket(c.bw)
+			var wait time.Duration
+			for _, n := range c.reserve {
+				wait = b.reserve(n)
+			}
+			if c.wantWait && wait <= 0 {
+				t.Fatalf("expected want wait but got %v", wait)
+			}
+			if !c.wantWait && wait != 0 {
+				t.Fatalf("expected want no wait but got %v", wait)
+			}
+		})
+	}
+}
+
+func TestTokenBucketSetLimitDebt(t *testing.T) {
+	b := newTokenBucket(Bandwidth{Rate: 1000})
+	b.reserve(100000)
+
+	// The debt of 99s is capped to one burst
+	b.setLimit(Bandwidth{Rate: 2000})
+	if wait := b.reserve(0); wait > 1100*time.Millisecond {
+		t.Fatalf("expected debt capped to 1s but got %v", wait)
+	}
+}
+
+// pipeThrottled sends size bytes through tunnel.pipe and returns how long it took.
+func pipeThrottled(t *testing.T, buckets []*tokenBucket, size int) time.Duration {
+	client, server := tcpPair(t)
+	target, remote := tcpPair(t)
+	go func() {
+		client.Write(make([]byte, size))
+		client.CloseWrite()
+	}()
+	go io.Copy(io.Discard, remote)
+
+	tun := newTestTunnel(nil)
+	tun.bandwidth = &tunnelBandwidth{down: buckets}
+	start := time.Now()
+	n, err := tun.pipe(target, server, false)
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	if n != int64(size) {
+		t.Fatalf("expected %v bytes but got %v", size, n)
+	}
+	return time.Since(start)
+}
+
+func TestPipeThrottled(t *testing.T) {
+	b := newTokenBucket(Bandwidth{Rate: 64 << 10, Burst: 16 << 10})
+
+	// The burst is free, the remaining 48KiB take 0.75s
+	if elapsed := pipeThrottled(t, []*tokenBucket{b}, 64<<10); elapsed < 600*time.Millisecond {
+		t.Fatalf("expected copy to be throttled but took %v", elapsed)
+	}
+}
+
+func TestPipeThrottledInterrupted(t *testing.T) {
+	client, server := tcpPair(t)
+	target, remote := tcpPair(t)
+	go client.Write(make([]byte, 64<<10))
+	go io.Copy(io.Discard, remote)
+
+	// The transfer would take a minute, ending the session interrupts it
+	done := make(chan struct{})
+	tun := newTestTunnel(nil)
+	tun.bandwidth = &tunnelBandwidth{down: []*tokenBucket{newTokenBucket(Bandwidth{Rate: 1000})}}
+	tun.done = done
+	time.AfterFunc(100*time.Millisecond, func() { close(done) })
+
+	start := time.Now()
+	_, err := tun.pipe(target, server, false)
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected %v but got %v", net.ErrClosed, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected pipe to return on close but took %v", elapsed)
+	}
+}
+
+func TestBandwidthLimiterSet(t *testing.T) {
+	var l bandwidthLimiter
+	tunnel := l.open("admin")
+	other := l.open("admin")
+
+	// Limit the live tunnels
+	l.set(BandwidthLimits{
+		Users: map[string]Throttle{
+			"admin": {Download: Bandwidth{Rate: 1000}},
+		},
+	})
+	if elapsed := pipeThrottled(t, tunnel.down, 1500); elapsed < 400*time.Millisecond {
+		t.Fatalf("expected copy to be throttled but took %v", elapsed)
+	}
+
+	tunnel.close()
+	if len(l.users) != 1 {
+		t.Fatalf("expected %v user buckets but got %v", 1, len(l.users))
+	}
+	other.close()
+	if len(l.users) != 0 || len(l.conns) != 0 {
+		t.Fatalf("expected buckets released but got %v users, %v conns", len(l.users), len(l.conns))
+	}
+}
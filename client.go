@@ -0,0 +1,202 @@
+package socks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ContextDialer dials connections, as net.Dialer and Dialer do.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Dialer connects to targets through a SOCKS5 server with CONNECT
+// requests. Domain names are resolved by the server.
+type Dialer struct {
+	// Server is the host:port of the SOCKS5 server.
+	Server string
+
+	// Username and Password authenticate with the password method
+	// if Username is set, no authentication is offered otherwise.
+	Username string
+	Password string
+
+	// Forward dials the server, a net.Dialer if nil. A Dialer chains
+	// through another SOCKS5 server.
+	Forward ContextDialer
+}
+
+// ReplyError is a request failure reported by the SOCKS server.
+type ReplyError struct {
+	Reply Reply
+}
+
+func (e *ReplyError) Error() string {
+	return "socks server replied " + replyName(e.Reply)
+}
+
+// Dial connects to address through the SOCKS5 server.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address through the SOCKS5 server. The
+// network must be "tcp", "tcp4" or "tcp6", the server decides the
+// address family of the connection.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("socks dial %s %s: network not supported", network, address)
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("socks dial %s: invalid port", address)
+	}
+	if len(host) > 255 || len(d.Username) > 255 || len(d.Password) > 255 {
+		return nil, fmt.Errorf("socks dial %s: host or credentials too long", address)
+	}
+
+	forward := d.Forward
+	if forward == nil {
+		forward = new(net.Dialer)
+	}
+	conn, err := forward.DialContext(ctx, "tcp", d.Server)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.handshake(ctx, conn, host, uint16(port)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("socks dial %s via %s: %w", address, d.Server, err)
+	}
+	return conn, nil
+}
+
+// handshake authenticates with the server on conn and requests a
+// connection to host:port.
+func (d *Dialer) handshake(ctx context.Context, conn net.Conn, host string, port uint16) (err error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if ctx.Done() != nil {
+		done, exited := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(exited)
+			select {
+			case <-ctx.Done():
+				// unblock the handshake
+				conn.SetDeadline(time.Unix(1, 0))
+			case <-done:
+			}
+		}()
+		defer func() {
+			close(done)
+			<-exited
+			if err != nil && ctx.Err() != nil {
+				err = ctx.Err()
+			}
+		}()
+	}
+
+	method := MethodNoAuth
+	if d.Username != "" {
+		method = MethodPassword
+	}
+	buf := make([]byte, 255+PortLen)
+	if _, err := conn.Write(append(buf[:0], SOCKS5Version, 1, method)); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != SOCKS5Version {
+		return ErrVersionNotSupported
+	}
+	if buf[1] != method {
+		return ErrNoAcceptableMethod
+	}
+
+	if method == MethodPassword {
+		b := append(buf[:0], PasswordMethodVersion, byte(len(d.Username)))
+		b = append(b, d.Username...)
+		b = append(b, byte(len(d.Password)))
+		b = append(b, d.Password...)
+		if _, err := conn.Write(b); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return err
+		}
+		if buf[0] != PasswordMethodVersion {
+			return ErrMethodVersionNotSupported
+		}
+		if buf[1] != PasswordAuthSuccess {
+			return ErrPasswordAuthFailure
+		}
+	}
+
+	if _, err := conn.Write(appendClientRequestMsg(buf[:0], CmdConnect, host, port)); err != nil {
+		return err
+	}
+	return readServerReply(conn, buf)
+}
+
+// appendClientRequestMsg appends the request of cmd to host:port.
+func appendClientRequestMsg(b []byte, cmd Command, host string, port uint16) []byte {
+	b = append(b, SOCKS5Version, cmd, ReservedField)
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		b = append(b, DomainName, byte(len(host)))
+		b = append(b, host...)
+	case ip.To4() != nil:
+		b = append(b, IPv4Addr)
+		b = append(b, ip.To4()...)
+	default:
+		b = append(b, IPv6Addr)
+		b = append(b, ip.To16()...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+// readServerReply reads the reply to a request, buf must hold 255+PortLen
+// bytes. The bound address is discarded.
+func readServerReply(conn io.Reader, buf []byte) error {
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return err
+	}
+	if buf[0] != SOCKS5Version {
+		return ErrVersionNotSupported
+	}
+	reply, addrType := buf[1], buf[3]
+	var addrLen int
+	switch addrType {
+	case IPv4Addr:
+		addrLen = IPv4Len
+	case IPv6Addr:
+		addrLen = IPv6Len
+	case DomainName:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		addrLen = int(buf[0])
+	default:
+		return ErrAddrTypeNotSupported
+	}
+	if _, err := io.ReadFull(conn, buf[:addrLen+PortLen]); err != nil {
+		return err
+	}
+	if reply != ReplySucceeded {
+		return &ReplyError{Reply: reply}
+	}
+	return nil
+}
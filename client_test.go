@@ -0,0 +1,141 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// echoServer answers every connection with what it reads.
+func echoServer(t *testing.T) net.Listener {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return lis
+}
+
+// testServer runs a server with conf on a loopback port.
+func testServer(t *testing.T, conf *Config) *Server {
+	conf.Logger = DiscardLogger
+	s := &Server{Listeners: []Listener{{Address: "127.0.0.1:0"}}, Config: conf}
+	errc := waitListening(t, s, 1)
+	t.Cleanup(func() {
+		s.Close()
+		<-errc
+	})
+	return s
+}
+
+func TestDialer(t *testing.T) {
+	echo := echoServer(t)
+	conf := *testPasswordConf
+	s := testServer(t, &conf)
+	server := s.Addrs()[0].String()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	closed.Close()
+
+	cases := []struct {
+		name     string
+		dialer   *Dialer
+		address  string
+		expected error
+	}{
+		{"success", &Dialer{Server: server, Username: "admin", Password: "123456"}, echo.Addr().String(), nil},
+		{"domain", &Dialer{Server: server, Username: "admin", Password: "123456"}, "localhost:" + portOf(echo.Addr()), nil},
+		{"wrong_password", &Dialer{Server: server, Username: "admin", Password: "wrong"}, echo.Addr().String(), ErrPasswordAuthFailure},
+		{"no_auth", &Dialer{Server: server}, echo.Addr().String(), ErrNoAcceptableMethod},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn, err := c.dialer.Dial("tcp", c.address)
+			if c.expected != nil {
+				if !errors.Is(err, c.expected) {
+					t.Fatalf("expected want error %v but got %v", c.expected, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected want nil but got error: %+v", err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("ping"))
+			got := make([]byte, 4)
+			if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+				t.Fatalf("expected %q but got %q and %v", "ping", got, err)
+			}
+		})
+	}
+
+	var replyErr *ReplyError
+	_, err = (&Dialer{Server: server, Username: "admin", Password: "123456"}).Dial("tcp", closed.Addr().String())
+	if !errors.As(err, &replyErr) || replyErr.Reply != ReplyConnectionRefused {
+		t.Fatalf("expected reply %v but got %v", ReplyConnectionRefused, err)
+	}
+	if _, err := new(Dialer).Dial("udp", echo.Addr().String()); err == nil {
+		t.Fatalf("expected an error for network %v but got nil", "udp")
+	}
+}
+
+func TestDialerContext(t *testing.T) {
+	// A server which never answers the greeting
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err = (&Dialer{Server: lis.Addr().String()}).DialContext(ctx, "tcp", "example.com:80")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected want error %v but got %v", context.Canceled, err)
+	}
+}
+
+func TestAppendClientRequestMsg(t *testing.T) {
+	for _, host := range []string{"example.com", "127.0.0.1", "::1"} {
+		b := appendClientRequestMsg(nil, CmdConnect, host, 443)
+		msg, err := NewClientRequestMsg(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("expected want nil but got error: %+v", err)
+		}
+		if msg.Command != CmdConnect || msg.Address != host || msg.Port != 443 || msg.AddrType != hostAddrType(host) {
+			t.Fatalf("expected request to %v:%v but got %+v", host, 443, msg)
+		}
+	}
+}
+
+func portOf(addr net.Addr) string {
+	_, port, _ := net.SplitHostPort(addr.String())
+	return port
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"time"
+
+	"github.com/startdusk/go-socks"
+)
+
+const defaultBridgeListen = "127.0.0.1:8080"
+
+// runHTTPBridge runs the http-bridge mode, an HTTP proxy making its
+// connections through a SOCKS5 server, for tools which only speak
+// HTTP proxies:
+//
+//	$ SOCKS_PASSWORD=123456 socks http-bridge -server proxy:1080 -user admin
+//	$ curl -v --proxy http://127.0.0.1:8080 https://www.baidu.com
+func runHTTPBridge(args []string) error {
+	fs := flag.NewFlagSet("socks http-bridge", flag.ExitOnError)
+	var client clientFlags
+	listen := fs.String("listen", defaultBridgeListen, "local `address` of the HTTP proxy")
+	client.register(fs)
+	fs.Parse(args)
+
+	if err := checkAddr("listen", *listen); err != nil {
+		return err
+	}
+	dialer, logger, err := client.build()
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Addr:              *listen,
+		Handler:           &socks.HTTPBridge{Dialer: dialer, Logger: logger},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	closeOnSignal(srv)
+	logger.Info("bridging", "addr", *listen, "server", dialer.Server)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/startdusk/go-socks"
+)
+
+// clientFlags are the flags of the modes connecting through a SOCKS5
+// server. The password is read from SOCKS_PASSWORD so it doesn't show
+// in the process list.
+type clientFlags struct {
+	server   string
+	user     string
+	logLevel string
+}
+
+func (c *clientFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.server, "server", "", "`address` of the SOCKS5 server")
+	fs.StringVar(&c.user, "user", "", "`username` authenticating with the server, the password is read from SOCKS_PASSWORD")
+	fs.StringVar(&c.logLevel, "log-level", "", "log `level`, debug, info, warn or error")
+}
+
+// build returns the dialer and the logger of the flags.
+func (c *clientFlags) build() (*socks.Dialer, socks.Logger, error) {
+	if err := checkAddr("server", c.server); err != nil {
+		return nil, nil, err
+	}
+	level, ok := logLevels[c.logLevel]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown log level %q, want debug, info, warn or error", c.logLevel)
+	}
+	d := &socks.Dialer{
+		Server:   c.server,
+		Username: c.user,
+		Password: os.Getenv("SOCKS_PASSWORD"),
+	}
+	return d, socks.NewLogger(os.Stderr, level), nil
+}
+
+// checkAddr verifies the host:port given to flag.
+func checkAddr(flag, addr string) error {
+	if addr == "" {
+		return fmt.Errorf("-%s must be set", flag)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("-%s: %v", flag, err)
+	}
+	return nil
+}
+
+// closeOnSignal closes c on SIGTERM or SIGINT.
+func closeOnSignal(c io.Closer) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-signals
+		c.Close()
+	}()
+}
@@ -0,0 +1,671 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/startdusk/go-socks"
+)
+
+const defaultListen = "127.0.0.1:1080"
+
+// fileConfig is the JSON configuration file of the daemon.
+// Durations are strings such as "10s" or "1m30s".
+type fileConfig struct {
+	// Listen is the host:port of the SOCKS listener, a shorthand
+	// for a single entry of Listeners
+	Listen    string           `json:"listen"`
+	Listeners []listenerConfig `json:"listeners"`
+
+	Auth      authConfig               `json:"auth"`
+	Profiles  map[string]profileConfig `json:"profiles"`
+	DNS       dnsConfig                `json:"dns"`
+	Outbound  *outboundConfig          `json:"outbound"`
+	Timeouts  timeoutsConfig           `json:"timeouts"`
+	Limits    limitsConfig             `json:"limits"`
+	Log       logConfig                `json:"log"`
+	AccessLog *accessLogConfig         `json:"access_log"`
+	Metrics   *metricsConfig           `json:"metrics"`
+	Admin     *adminConfig             `json:"admin"`
+
+	// UserOutbound overrides outbound for the users it names
+	UserOutbound map[string]*outboundConfig `json:"user_outbound"`
+	Bandwidth    bandwidthConfig            `json:"bandwidth"`
+	Quotas       *quotasConfig              `json:"quotas"`
+
+	ProxyProtocol *proxyProtocolConfig `json:"proxy_protocol"`
+}
+
+type listenerConfig struct {
+	// Network is "tcp", "tcp4", "tcp6" or "unix"
+	Network string `json:"network"`
+	Address string `json:"address"`
+	// FD is an inherited listening socket used instead of the address
+	FD *int `json:"fd"`
+	// FDName selects the socket passed by systemd socket activation
+	// with this FileDescriptorName instead of the address
+	FDName string `json:"fd_name"`
+	// Profile names an entry of profiles
+	Profile string `json:"profile"`
+	// Transparent is "redirect" or "tproxy" to accept connections
+	// redirected by iptables rules of that target instead of SOCKS
+	Transparent string `json:"transparent"`
+}
+
+// profileConfig overrides auth and outbound for listeners selecting it.
+type profileConfig struct {
+	Auth     authConfig      `json:"auth"`
+	Outbound *outboundConfig `json:"outbound"`
+}
+
+type authConfig struct {
+	// Method is "none" or "password"
+	Method string `json:"method"`
+	// Users maps usernames to passwords, in addition to UsersFile
+	Users map[string]string `json:"users"`
+	// UsersFile holds one "username:password" line per user
+	UsersFile string `json:"users_file"`
+}
+
+// dnsConfig configures the DNS cache, see socks.CacheResolver. The
+// system resolver doesn't report record TTLs, so answers are cached
+// for default_ttl, clamped by min_ttl and max_ttl.
+type dnsConfig struct {
+	DisableCache bool   `json:"disable_cache"`
+	DefaultTTL   string `json:"default_ttl"`
+	MinTTL       string `json:"min_ttl"`
+	MaxTTL       string `json:"max_ttl"`
+	NegativeTTL  string `json:"negative_ttl"`
+	MaxEntries   int    `json:"max_entries"`
+	// ResolveCommands answers the RESOLVE and RESOLVE_PTR commands
+	ResolveCommands bool `json:"resolve_commands"`
+}
+
+type outboundConfig struct {
+	LocalIPs  []string `json:"local_ips"`
+	Interface string   `json:"interface"`
+	// ProxyHeader is the PROXY protocol version, 1 or 2, of a header
+	// sent to targets with the client address, none if 0
+	ProxyHeader int `json:"proxy_header"`
+}
+
+type timeoutsConfig struct {
+	Handshake     string `json:"handshake"`
+	Idle          string `json:"idle"`
+	MaxLifetime   string `json:"max_lifetime"`
+	FallbackDelay string `json:"fallback_delay"`
+	// Shutdown is how long open sessions may go on after a stop
+	// signal, default 30s
+	Shutdown string `json:"shutdown"`
+}
+
+type limitsConfig struct {
+	MaxSessions          int    `json:"max_sessions"`
+	MaxSessionsPerClient int    `json:"max_sessions_per_client"`
+	MaxSessionsPerUser   int    `json:"max_sessions_per_user"`
+	QueueTimeout         string `json:"queue_timeout"`
+}
+
+// bandwidthConfig throttles tunnels, see socks.BandwidthLimits.
+type bandwidthConfig struct {
+	Global  throttleConfig            `json:"global"`
+	PerUser throttleConfig            `json:"per_user"`
+	Users   map[string]throttleConfig `json:"users"`
+	PerConn throttleConfig            `json:"per_conn"`
+}
+
+type throttleConfig struct {
+	Upload   rateConfig `json:"upload"`
+	Download rateConfig `json:"download"`
+}
+
+// rateConfig is in bytes per second, unlimited if zero
+type rateConfig struct {
+	Rate  int64 `json:"rate"`
+	Burst int64 `json:"burst"`
+}
+
+type quotasConfig struct {
+	Default quotaConfig            `json:"default"`
+	Users   map[string]quotaConfig `json:"users"`
+	// CutLive also closes the open tunnels of users over their quota
+	CutLive bool `json:"cut_live"`
+	// Store is the file keeping the usage counters across restarts
+	Store         string `json:"store"`
+	FlushInterval string `json:"flush_interval"`
+}
+
+// quotaConfig is in bytes, unlimited if zero
+type quotaConfig struct {
+	Daily   int64 `json:"daily"`
+	Monthly int64 `json:"monthly"`
+}
+
+type proxyProtocolConfig struct {
+	// Trusted are the CIDRs or IPs of the load balancers
+	Trusted []string `json:"trusted"`
+}
+
+type logConfig struct {
+	// Level is "debug", "info", "warn" or "error"
+	Level string `json:"level"`
+	// File is the log file, stderr if empty
+	File string `json:"file"`
+}
+
+type accessLogConfig struct {
+	Path       string `json:"path"`
+	Format     string `json:"format"`
+	MaxSize    int64  `json:"max_size"`
+	MaxAge     string `json:"max_age"`
+	MaxBackups int    `json:"max_backups"`
+}
+
+type metricsConfig struct {
+	Addr string `json:"addr"`
+}
+
+type adminConfig struct {
+	Addr  string `json:"addr"`
+	Token string `json:"token"`
+}
+
+// loadConfig reads the configuration file at path. Syntax and type
+// errors are reported with their line and column.
+func loadConfig(path string) (*fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(path, data)
+}
+
+func parseConfig(name string, data []byte) (*fileConfig, error) {
+	c := new(fileConfig)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		var (
+			syntaxErr *json.SyntaxError
+			typeErr   *json.UnmarshalTypeError
+		)
+		switch {
+		case errors.As(err, &syntaxErr):
+			// Offset is past the offending byte
+			return nil, fmt.Errorf("%s:%s: %v", name, position(data, syntaxErr.Offset-1), err)
+		case errors.As(err, &typeErr):
+			// Offset is past the offending value
+			return nil, fmt.Errorf("%s:%s: %v", name, position(data, typeErr.Offset), err)
+		case err == io.ErrUnexpectedEOF:
+			return nil, fmt.Errorf("%s:%s: unexpected end of file", name, position(data, int64(len(data))))
+		}
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("%s:%s: data after configuration", name, position(data, dec.InputOffset()))
+	}
+	return c, nil
+}
+
+// position returns the line:column of the byte at offset.
+func position(data []byte, offset int64) string {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte{'\n'}) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Sprintf("%d:%d", line, col)
+}
+
+// configError lists the invalid settings of a configuration.
+type configError []string
+
+func (e configError) Error() string {
+	return "invalid configuration:\n\t" + strings.Join(e, "\n\t")
+}
+
+// builder converts a fileConfig to a socks.Config, collecting the
+// errors of every invalid setting.
+type builder struct {
+	errs  configError
+	files *logFiles
+}
+
+func (b *builder) errorf(field, format string, args ...any) {
+	b.errs = append(b.errs, field+": "+fmt.Sprintf(format, args...))
+}
+
+func (b *builder) duration(field, s string) time.Duration {
+	if s == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		b.errorf(field, "invalid duration %q", s)
+	}
+	return d
+}
+
+func (b *builder) count(field string, n int) int {
+	if n < 0 {
+		b.errorf(field, "must not be negative")
+	}
+	return n
+}
+
+func (b *builder) bytes(field string, n int64) int64 {
+	if n < 0 {
+		b.errorf(field, "must not be negative")
+	}
+	return n
+}
+
+// build validates the configuration and returns the server
+// configuration. Its log files are taken from files.
+func (c *fileConfig) build(files *logFiles) (*socks.Config, error) {
+	b := &builder{files: files}
+	conf := new(socks.Config)
+
+	if c.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+			b.errorf("listen", "%v", err)
+		}
+		if len(c.Listeners) > 0 {
+			b.errorf("listen", "can't be combined with listeners")
+		}
+	}
+	for i, l := range c.Listeners {
+		field := fmt.Sprintf("listeners[%d]", i)
+		switch {
+		case l.FD != nil:
+			if *l.FD < 0 {
+				b.errorf(field+".fd", "must not be negative")
+			}
+		case l.FDName != "":
+		case l.Address == "":
+			b.errorf(field+".address", "must be set")
+		}
+		switch l.Transparent {
+		case "", socks.TransparentRedirect, socks.TransparentTProxy:
+		default:
+			b.errorf(field+".transparent", "unknown mode %q, want redirect or tproxy", l.Transparent)
+		}
+		if l.Transparent != "" && l.Network == "unix" {
+			b.errorf(field+".transparent", "needs a TCP network")
+		}
+		switch l.Network {
+		case "", "tcp", "tcp4", "tcp6", "unix":
+		default:
+			b.errorf(field+".network", "unknown network %q, want tcp, tcp4, tcp6 or unix", l.Network)
+		}
+		if _, ok := c.Profiles[l.Profile]; l.Profile != "" && !ok {
+			b.errorf(field+".profile", "unknown profile %q", l.Profile)
+		}
+	}
+
+	conf.AuthMethod, conf.PasswordChecker = b.auth("auth", c.Auth)
+	conf.Outbound = b.outbound("outbound", c.Outbound)
+	if len(c.UserOutbound) > 0 {
+		conf.UserOutbound = make(map[string]*socks.Outbound)
+	}
+	for user, o := range c.UserOutbound {
+		if o == nil {
+			b.errorf("user_outbound."+user, "must be set")
+			continue
+		}
+		conf.UserOutbound[user] = b.outbound("user_outbound."+user, o)
+	}
+	if len(c.Profiles) > 0 {
+		conf.Profiles = make(map[string]*socks.Profile)
+	}
+	for name, p := range c.Profiles {
+		field := "profiles." + name
+		profile := &socks.Profile{Outbound: b.outbound(field+".outbound", p.Outbound)}
+		profile.AuthMethod, profile.PasswordChecker = b.auth(field+".auth", p.Auth)
+		conf.Profiles[name] = profile
+	}
+
+	if !c.DNS.DisableCache {
+		conf.Resolver = &socks.CacheResolver{
+			DefaultTTL:  b.duration("dns.default_ttl", c.DNS.DefaultTTL),
+			MinTTL:      b.duration("dns.min_ttl", c.DNS.MinTTL),
+			MaxTTL:      b.duration("dns.max_ttl", c.DNS.MaxTTL),
+			NegativeTTL: b.duration("dns.negative_ttl", c.DNS.NegativeTTL),
+			MaxEntries:  b.count("dns.max_entries", c.DNS.MaxEntries),
+		}
+	}
+
+	conf.ResolveCommands = c.DNS.ResolveCommands
+
+	conf.HandshakeTimeout = b.duration("timeouts.handshake", c.Timeouts.Handshake)
+	conf.IdleTimeout = b.duration("timeouts.idle", c.Timeouts.Idle)
+	conf.MaxSessionLifetime = b.duration("timeouts.max_lifetime", c.Timeouts.MaxLifetime)
+	conf.FallbackDelay = b.duration("timeouts.fallback_delay", c.Timeouts.FallbackDelay)
+	b.duration("timeouts.shutdown", c.Timeouts.Shutdown)
+
+	conf.Limits = socks.Limits{
+		MaxSessions:          b.count("limits.max_sessions", c.Limits.MaxSessions),
+		MaxSessionsPerClient: b.count("limits.max_sessions_per_client", c.Limits.MaxSessionsPerClient),
+		MaxSessionsPerUser:   b.count("limits.max_sessions_per_user", c.Limits.MaxSessionsPerUser),
+		QueueTimeout:         b.duration("limits.queue_timeout", c.Limits.QueueTimeout),
+	}
+	conf.Bandwidth = b.bandwidth("bandwidth", c.Bandwidth)
+	if q := c.Quotas; q != nil {
+		conf.Quotas = socks.QuotaLimits{
+			Default:       b.quota("quotas.default", q.Default),
+			CutLive:       q.CutLive,
+			FlushInterval: b.duration("quotas.flush_interval", q.FlushInterval),
+		}
+		if len(q.Users) > 0 {
+			conf.Quotas.Users = make(map[string]socks.Quota)
+		}
+		for user, quota := range q.Users {
+			conf.Quotas.Users[user] = b.quota("quotas.users."+user, quota)
+		}
+		if q.Store != "" {
+			conf.Quotas.Store = socks.FileQuotaStore{Path: q.Store}
+		}
+	}
+
+	if p := c.ProxyProtocol; p != nil {
+		conf.ProxyProtocol = new(socks.ProxyProtocol)
+		for i, cidr := range p.Trusted {
+			n, err := parseCIDR(cidr)
+			if err != nil {
+				b.errorf(fmt.Sprintf("proxy_protocol.trusted[%d]", i), "invalid CIDR %q", cidr)
+				continue
+			}
+			conf.ProxyProtocol.Trusted = append(conf.ProxyProtocol.Trusted, n)
+		}
+		if len(p.Trusted) == 0 {
+			b.errorf("proxy_protocol.trusted", "must be set")
+		}
+	}
+
+	level, ok := logLevels[c.Log.Level]
+	if !ok {
+		b.errorf("log.level", "unknown level %q, want debug, info, warn or error", c.Log.Level)
+	}
+	var w io.Writer = os.Stderr
+	if c.Log.File != "" {
+		w = files.get(c.Log.File)
+	}
+	conf.Logger = socks.NewLogger(w, level)
+
+	var openAccessLog func()
+	if a := c.AccessLog; a != nil {
+		maxAge := b.duration("access_log.max_age", a.MaxAge)
+		maxBackups := b.count("access_log.max_backups", a.MaxBackups)
+		if a.Path == "" {
+			b.errorf("access_log.path", "must be set")
+		}
+		format := a.Format
+		if format == "" {
+			format = socks.DefaultAccessLogFormat
+		}
+		if _, err := socks.NewAccessLogger(io.Discard, format); err != nil {
+			b.errorf("access_log.format", "%v", err)
+		}
+		openAccessLog = func() {
+			file := files.get(a.Path)
+			file.SetLimits(a.MaxSize, maxAge, maxBackups)
+			conf.AccessLog, _ = socks.NewAccessLogger(file, format)
+		}
+	}
+
+	if m := c.Metrics; m != nil {
+		if m.Addr == "" {
+			b.errorf("metrics.addr", "must be set")
+		}
+		conf.MetricsAddr = m.Addr
+	}
+
+	if a := c.Admin; a != nil {
+		if a.Token == "" {
+			b.errorf("admin.token", "must be set")
+		}
+		conf.Admin = &socks.Admin{Addr: a.Addr, Token: a.Token}
+	}
+
+	if len(b.errs) > 0 {
+		return nil, b.errs
+	}
+	// the file may be shared with the running configuration, so its
+	// limits only change once this one is valid
+	if openAccessLog != nil {
+		openAccessLog()
+	}
+	return conf, nil
+}
+
+func (b *builder) auth(field string, c authConfig) (socks.Method, func(username, password string) bool) {
+	switch c.Method {
+	case "", "none":
+		return socks.MethodNoAuth, nil
+	case "password":
+	default:
+		b.errorf(field+".method", "unknown method %q, want none or password", c.Method)
+		return socks.MethodNoAuth, nil
+	}
+
+	users := make(map[string]string)
+	if c.UsersFile != "" {
+		fileUsers, err := loadUsers(c.UsersFile)
+		if err != nil {
+			b.errorf(field+".users_file", "%v", err)
+		}
+		for user, password := range fileUsers {
+			users[user] = password
+		}
+	}
+	for user, password := range c.Users {
+		users[user] = password
+	}
+	if len(users) == 0 {
+		b.errorf(field, "password authentication needs users or users_file")
+	}
+	return socks.MethodPassword, func(username, password string) bool {
+		want, ok := users[username]
+		return ok && want == password
+	}
+}
+
+func (b *builder) bandwidth(field string, c bandwidthConfig) socks.BandwidthLimits {
+	l := socks.BandwidthLimits{
+		Global:  b.throttle(field+".global", c.Global),
+		PerUser: b.throttle(field+".per_user", c.PerUser),
+		PerConn: b.throttle(field+".per_conn", c.PerConn),
+	}
+	if len(c.Users) > 0 {
+		l.Users = make(map[string]socks.Throttle)
+	}
+	for user, t := range c.Users {
+		l.Users[user] = b.throttle(field+".users."+user, t)
+	}
+	return l
+}
+
+func (b *builder) throttle(field string, c throttleConfig) socks.Throttle {
+	return socks.Throttle{
+		Upload:   b.rate(field+".upload", c.Upload),
+		Download: b.rate(field+".download", c.Download),
+	}
+}
+
+func (b *builder) rate(field string, c rateConfig) socks.Bandwidth {
+	return socks.Bandwidth{
+		Rate:  b.bytes(field+".rate", c.Rate),
+		Burst: b.bytes(field+".burst", c.Burst),
+	}
+}
+
+func (b *builder) quota(field string, c quotaConfig) socks.Quota {
+	return socks.Quota{
+		Daily:   b.bytes(field+".daily", c.Daily),
+		Monthly: b.bytes(field+".monthly", c.Monthly),
+	}
+}
+
+func (b *builder) outbound(field string, c *outboundConfig) *socks.Outbound {
+	if c == nil {
+		return nil
+	}
+	o := &socks.Outbound{Interface: c.Interface, ProxyHeader: c.ProxyHeader}
+	if c.ProxyHeader < 0 || c.ProxyHeader > 2 {
+		b.errorf(field+".proxy_header", "unknown version %d, want 1 or 2", c.ProxyHeader)
+	}
+	var v4, v6 bool
+	for i, s := range c.LocalIPs {
+		ipField := fmt.Sprintf("%s.local_ips[%d]", field, i)
+		ip := net.ParseIP(s)
+		if ip == nil {
+			b.errorf(ipField, "invalid IP address %q", s)
+			continue
+		}
+		family, seen := "IPv6", &v6
+		if ip.To4() != nil {
+			family, seen = "IPv4", &v4
+		}
+		if *seen {
+			b.errorf(ipField, "second %s address %q, at most one per address family", family, s)
+			continue
+		}
+		*seen = true
+		o.LocalIPs = append(o.LocalIPs, ip)
+	}
+	if c.Interface != "" {
+		if _, err := net.InterfaceByName(c.Interface); err != nil {
+			b.errorf(field+".interface", "%v", err)
+		}
+	}
+	return o
+}
+
+// serverListeners returns the listeners of a built configuration.
+func (c *fileConfig) serverListeners() []socks.Listener {
+	if len(c.Listeners) == 0 {
+		listen := c.Listen
+		if listen == "" {
+			listen = defaultListen
+		}
+		return []socks.Listener{{Address: listen}}
+	}
+	listeners := make([]socks.Listener, len(c.Listeners))
+	for i, l := range c.Listeners {
+		listeners[i] = socks.Listener{
+			Network:     l.Network,
+			Address:     l.Address,
+			Profile:     l.Profile,
+			Transparent: l.Transparent,
+		}
+		if l.FD != nil {
+			listeners[i].File = os.NewFile(uintptr(*l.FD), fmt.Sprintf("fd %d", *l.FD))
+		}
+	}
+	return listeners
+}
+
+const defaultShutdownTimeout = 30 * time.Second
+
+// shutdownTimeout returns how long sessions may go on after a stop
+// signal, the configuration must have been built.
+func (c *fileConfig) shutdownTimeout() time.Duration {
+	d, _ := time.ParseDuration(c.Timeouts.Shutdown)
+	if d == 0 {
+		return defaultShutdownTimeout
+	}
+	return d
+}
+
+// listenerKey identifies the listener settings, to detect changes.
+func (c *fileConfig) listenerKey() string {
+	data, _ := json.Marshal([]any{c.Listen, c.Listeners})
+	return string(data)
+}
+
+var logLevels = map[string]socks.LogLevel{
+	"":      socks.LevelInfo,
+	"debug": socks.LevelDebug,
+	"info":  socks.LevelInfo,
+	"warn":  socks.LevelWarn,
+	"error": socks.LevelError,
+}
+
+// parseCIDR parses a CIDR, or an IP as the network of that IP alone.
+func parseCIDR(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// loadUsers reads a users file of "username:password" lines.
+// Empty lines and lines starting with # are ignored.
+func loadUsers(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, password, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: want username:password", path, n)
+		}
+		users[user] = password
+	}
+	return users, scanner.Err()
+}
+
+// logFiles keeps one RotatingFile per path for the life of the daemon,
+// so sessions still using a previous configuration write to the same
+// files as new ones, and a file is rotated by one writer only.
+type logFiles struct {
+	mu    sync.Mutex
+	files map[string]*socks.RotatingFile
+}
+
+// get returns the file of path, created on the first call.
+func (l *logFiles) get(path string) *socks.RotatingFile {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f, ok := l.files[path]; ok {
+		return f
+	}
+	if l.files == nil {
+		l.files = make(map[string]*socks.RotatingFile)
+	}
+	f := &socks.RotatingFile{Path: path}
+	l.files[path] = f
+	return f
+}
+
+func (l *logFiles) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, f := range l.files {
+		f.Close()
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/startdusk/go-socks"
+)
+
+func TestParseConfigErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		data   string
+		expect string
+	}{
+		{
+			name:   "syntax",
+			data:   "{\n\t\"listen\": \"127.0.0.1:1080\"\n\t\"auth\": {}\n}",
+			expect: "socks.json:3:2: invalid character",
+		},
+		{
+			name:   "type",
+			data:   "{\n\t\"limits\": {\"max_sessions\": \"ten\"}\n}",
+			expect: "socks.json:2:34: json: cannot unmarshal string",
+		},
+		{
+			name:   "unknown_field",
+			data:   `{"listn": "127.0.0.1:1080"}`,
+			expect: `socks.json: json: unknown field "listn"`,
+		},
+		{
+			name:   "truncated",
+			data:   "{\n\t\"listen\": ",
+			expect: "socks.json:2:12: unexpected end of file",
+		},
+		{
+			name:   "trailing_data",
+			data:   "{}\n{}",
+			expect: "socks.json:2:1: data after configuration",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := parseConfig("socks.json", []byte(c.data))
+			if err == nil || !strings.HasPrefix(err.Error(), c.expect) {
+				t.Fatalf("expected error %q but got %v", c.expect, err)
+			}
+		})
+	}
+}
+
+func TestBuildConfig(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil || len(ifaces) == 0 {
+		t.Fatalf("expected network interfaces but got %v, error: %+v", ifaces, err)
+	}
+	iface := ifaces[0].Name
+	dir := t.TempDir()
+	usersFile := filepath.Join(dir, "users")
+	os.WriteFile(usersFile, []byte("# team\nadmin:123456\n\nhulu:hulubell\n"), 0o600)
+
+	c, err := parseConfig("socks.json", []byte(`{
+		"listen": "127.0.0.1:1080",
+		"auth": {"method": "password", "users_file": "`+usersFile+`", "users": {"startdusk": "abc123"}},
+		"timeouts": {"handshake": "5s", "idle": "1m"},
+		"limits": {"max_sessions": 10, "queue_timeout": "100ms"},
+		"bandwidth": {"per_user": {"download": {"rate": 1048576}}, "users": {"admin": {"upload": {"rate": 1024, "burst": 4096}}}},
+		"quotas": {"default": {"monthly": 1073741824}, "users": {"admin": {"daily": 0}}, "store": "`+filepath.Join(dir, "usage.json")+`", "flush_interval": "30s"},
+		"user_outbound": {"admin": {"interface": "`+iface+`"}},
+		"dns": {"resolve_commands": true},
+		"log": {"level": "debug"},
+		"access_log": {"path": "`+filepath.Join(dir, "access.log")+`", "format": "json"},
+		"admin": {"token": "secret"},
+		"proxy_protocol": {"trusted": ["10.0.0.0/8", "192.0.2.1"]}
+	}`))
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	var files logFiles
+	defer files.close()
+	conf, err := c.build(&files)
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+
+	if conf.AuthMethod != socks.MethodPassword {
+		t.Fatalf("expected method %v but got %v", socks.MethodPassword, conf.AuthMethod)
+	}
+	for user, password := range map[string]string{"admin": "123456", "hulu": "hulubell", "startdusk": "abc123"} {
+		if !conf.PasswordChecker(user, password) {
+			t.Fatalf("expected %v to authenticate", user)
+		}
+	}
+	if conf.PasswordChecker("admin", "wrong") {
+		t.Fatalf("expected wrong password to fail")
+	}
+	if conf.HandshakeTimeout != 5*time.Second || conf.IdleTimeout != time.Minute {
+		t.Fatalf("expected timeouts %v and %v but got %v and %v", 5*time.Second, time.Minute, conf.HandshakeTimeout, conf.IdleTimeout)
+	}
+	if conf.Limits.MaxSessions != 10 || conf.Limits.QueueTimeout != 100*time.Millisecond {
+		t.Fatalf("expected limits of %v sessions but got %+v", 10, conf.Limits)
+	}
+	if _, ok := conf.Resolver.(*socks.CacheResolver); !ok || !conf.ResolveCommands {
+		t.Fatalf("expected a cache resolver answering resolve commands but got %T and %v", conf.Resolver, conf.ResolveCommands)
+	}
+	if conf.AccessLog == nil || conf.Admin == nil || conf.Admin.Token != "secret" {
+		t.Fatalf("expected access log and admin API to be configured")
+	}
+	if b := conf.Bandwidth; b.PerUser.Download.Rate != 1048576 || b.Users["admin"].Upload != (socks.Bandwidth{Rate: 1024, Burst: 4096}) {
+		t.Fatalf("expected bandwidth limits but got %+v", b)
+	}
+	q := conf.Quotas
+	if q.Default.Monthly != 1<<30 || q.Users["admin"] != (socks.Quota{}) || q.FlushInterval != 30*time.Second {
+		t.Fatalf("expected quotas but got %+v", q)
+	}
+	if store, ok := q.Store.(socks.FileQuotaStore); !ok || store.Path != filepath.Join(dir, "usage.json") {
+		t.Fatalf("expected a quota store file but got %+v", q.Store)
+	}
+	if o := conf.UserOutbound["admin"]; o == nil || o.Interface != iface {
+		t.Fatalf("expected the outbound of %v but got %+v", "admin", o)
+	}
+	if p := conf.ProxyProtocol; p == nil || len(p.Trusted) != 2 || p.Trusted[1].String() != "192.0.2.1/32" {
+		t.Fatalf("expected trusted networks %v and %v but got %+v", "10.0.0.0/8", "192.0.2.1/32", p)
+	}
+}
+
+func TestBuildConfigInvalid(t *testing.T) {
+	c, err := parseConfig("socks.json", []byte(`{
+		"listen": "1080",
+		"auth": {"method": "password"},
+		"outbound": {"proxy_header": 3, "local_ips": ["192.0.2.1", "192.0.2.2"], "interface": "missing0"},
+		"user_outbound": {"admin": {"local_ips": ["localhost"]}},
+		"timeouts": {"idle": "5 minutes"},
+		"limits": {"max_sessions": -1},
+		"bandwidth": {"users": {"admin": {"upload": {"rate": -1}}}},
+		"quotas": {"default": {"monthly": -1}, "flush_interval": "soon"},
+		"log": {"level": "verbose"},
+		"admin": {},
+		"proxy_protocol": {"trusted": ["10.0.0.0/33"]}
+	}`))
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	_, err = c.build(new(logFiles))
+	errs, ok := err.(configError)
+	if !ok {
+		t.Fatalf("expected configuration errors but got %v", err)
+	}
+	expect := []string{"listen: ", "auth: ", "outbound.proxy_header: ", "outbound.local_ips[1]: ", "outbound.interface: ", "user_outbound.admin.local_ips[0]: ", "timeouts.idle: ", "limits.max_sessions: ",
+		"bandwidth.users.admin.upload.rate: ", "quotas.default.monthly: ", "quotas.flush_interval: ", "proxy_protocol.trusted[0]: ", "log.level: ", "admin.token: "}
+	if len(errs) != len(expect) {
+		t.Fatalf("expected %v errors but got %v", len(expect), err)
+	}
+	for i, prefix := range expect {
+		if !strings.HasPrefix(errs[i], prefix) {
+			t.Fatalf("expected error %v about %q but got %q", i, prefix, errs[i])
+		}
+	}
+}
+
+func TestLoadUsersInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	os.WriteFile(path, []byte("admin:123456\nhulu\n"), 0o600)
+	_, err := loadUsers(path)
+	if err == nil || err.Error() != path+":2: want username:password" {
+		t.Fatalf("expected error at line %v but got %v", 2, err)
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	c := &fileConfig{Listen: "127.0.0.1:1080"}
+	c.Log.Level = "info"
+	o := overrides{listen: "[::1]:1081", logLevel: "debug", adminAddr: ":1090"}
+	os.Setenv("SOCKS_ADMIN_TOKEN", "secret")
+	defer os.Unsetenv("SOCKS_ADMIN_TOKEN")
+	o.apply(c)
+
+	if c.Listen != "[::1]:1081" || c.Log.Level != "debug" {
+		t.Fatalf("expected overridden listen and level but got %v and %v", c.Listen, c.Log.Level)
+	}
+	if c.Admin == nil || c.Admin.Addr != ":1090" || c.Admin.Token != "secret" {
+		t.Fatalf("expected admin API on %v with token but got %+v", ":1090", c.Admin)
+	}
+}
+
+func TestBuildListeners(t *testing.T) {
+	c, err := parseConfig("socks.json", []byte(`{
+		"listeners": [
+			{"address": "127.0.0.1:1080"},
+			{"network": "unix", "address": "/run/socks.sock", "profile": "local"},
+			{"address": "127.0.0.1:1081", "transparent": "redirect"},
+			{"network": "udp", "fd": -1, "profile": "remote"},
+			{"address": "127.0.0.1:1082", "transparent": "nat"}
+		],
+		"profiles": {
+			"local": {"auth": {"method": "password", "users": {"admin": "123456"}}}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	_, err = c.build(new(logFiles))
+	expect := "invalid configuration:\n\tlisteners[3].fd: must not be negative" +
+		"\n\tlisteners[3].network: unknown network \"udp\", want tcp, tcp4, tcp6 or unix" +
+		"\n\tlisteners[3].profile: unknown profile \"remote\"" +
+		"\n\tlisteners[4].transparent: unknown mode \"nat\", want redirect or tproxy"
+	if err == nil || err.Error() != expect {
+		t.Fatalf("expected error %q but got %v", expect, err)
+	}
+
+	c.Listeners = c.Listeners[:3]
+	conf, err := c.build(new(logFiles))
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	if p := conf.Profiles["local"]; p == nil || p.AuthMethod != socks.MethodPassword || !p.PasswordChecker("admin", "123456") {
+		t.Fatalf("expected password profile %v but got %+v", "local", p)
+	}
+	listeners := c.serverListeners()
+	if len(listeners) != 3 || listeners[1].Network != "unix" || listeners[1].Profile != "local" || listeners[2].Transparent != socks.TransparentRedirect {
+		t.Fatalf("expected tcp, unix and transparent listeners but got %+v", listeners)
+	}
+}
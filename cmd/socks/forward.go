@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"flag"
+
+	"github.com/startdusk/go-socks"
+)
+
+// runForward runs the forward mode, which tunnels the connections of
+// a local port to a remote address through a SOCKS5 server:
+//
+//	$ SOCKS_PASSWORD=123456 socks forward -listen 127.0.0.1:5432 \
+//		-remote db.internal:5432 -server proxy:1080 -user admin
+func runForward(args []string) error {
+	fs := flag.NewFlagSet("socks forward", flag.ExitOnError)
+	f := new(socks.Forwarder)
+	var client clientFlags
+	fs.StringVar(&f.Listen, "listen", "", "local `address` to listen on")
+	fs.StringVar(&f.Remote, "remote", "", "`host:port` connected to by the SOCKS server")
+	client.register(fs)
+	fs.Parse(args)
+
+	if err := checkForward(f.Listen, f.Remote, client.server); err != nil {
+		return err
+	}
+	var err error
+	if f.Dialer, f.Logger, err = client.build(); err != nil {
+		return err
+	}
+	closeOnSignal(f)
+	if err := f.ListenAndServe(); err != socks.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// checkForward verifies the addresses of the forward mode.
+func checkForward(listen, remote, server string) error {
+	if err := checkAddr("listen", listen); err != nil {
+		return err
+	}
+	if err := checkAddr("remote", remote); err != nil {
+		return err
+	}
+	if err := checkAddr("server", server); err != nil {
+		return err
+	}
+	if listen == server {
+		return errors.New("-listen and -server are the same address")
+	}
+	return nil
+}
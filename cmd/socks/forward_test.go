@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckForward(t *testing.T) {
+	cases := []struct {
+		listen string
+		remote string
+		server string
+		expect string
+	}{
+		{"127.0.0.1:5432", "db.internal:5432", "proxy:1080", ""},
+		{"", "db.internal:5432", "proxy:1080", "-listen must be set"},
+		{"127.0.0.1:5432", "db.internal", "proxy:1080", "-remote: "},
+		{"127.0.0.1:5432", "db.internal:5432", "", "-server must be set"},
+		{"127.0.0.1:1080", "db.internal:5432", "127.0.0.1:1080", "-listen and -server are the same address"},
+	}
+	for _, c := range cases {
+		err := checkForward(c.listen, c.remote, c.server)
+		if c.expect == "" {
+			if err != nil {
+				t.Fatalf("expected want nil but got error: %+v", err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), c.expect) {
+			t.Fatalf("expected error %q but got %v", c.expect, err)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// handoffSignal asks the daemon to hand its listeners to a new process.
+var handoffSignal os.Signal = syscall.SIGUSR2
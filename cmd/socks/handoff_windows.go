@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// handoffSignal is nil, handing listeners over isn't supported on windows.
+var handoffSignal os.Signal
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/startdusk/go-socks"
+)
+
+func TestDaemonReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "socks.json")
+	os.WriteFile(path, []byte(`{"log": {"level": "error"}}`), 0o600)
+
+	d := &daemon{configPath: path}
+	defer d.files.close()
+	_, conf, err := d.load()
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	d.conf = conf
+	d.srv = &socks.Server{Config: conf}
+
+	os.WriteFile(path, []byte(`{"auth": {"method": "password"}}`), 0o600)
+	if err := d.reload(); err == nil || !strings.Contains(err.Error(), "needs users") {
+		t.Fatalf("expected invalid configuration to be refused but got %v", err)
+	}
+
+	os.WriteFile(path, []byte(`{"auth": {"method": "password", "users": {"admin": "123456"}}, "log": {"level": "error"}}`), 0o600)
+	if err := d.reload(); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	if d.logger() == conf.Logger {
+		t.Fatalf("expected the daemon to log with the reloaded configuration")
+	}
+}
+
+func TestDaemonReloadLogFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "socks.json")
+	logPath, accessPath := filepath.Join(dir, "socks.log"), filepath.Join(dir, "access.log")
+	config := `{"log": {"level": "info", "file": "` + logPath + `"}, "access_log": {"path": "` + accessPath + `", "max_size": %d}}`
+	os.WriteFile(path, []byte(strings.Replace(config, "%d", "1000", 1)), 0o600)
+
+	d := &daemon{configPath: path}
+	defer d.files.close()
+	_, conf, err := d.load()
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	d.conf = conf
+	d.srv = &socks.Server{Config: conf}
+	logFile, accessFile := d.files.get(logPath), d.files.get(accessPath)
+
+	// Sessions of the first configuration go on writing after reloads
+	for _, maxSize := range []string{"2000", "0"} {
+		os.WriteFile(path, []byte(strings.Replace(config, "%d", maxSize, 1)), 0o600)
+		if err := d.reload(); err != nil {
+			t.Fatalf("expected want nil but got error: %+v", err)
+		}
+	}
+	conf.Logger.Info("late record")
+	d.logger().Info("new record")
+	if len(d.files.files) != 2 || d.files.get(logPath) != logFile || d.files.get(accessPath) != accessFile {
+		t.Fatalf("expected one file per path but got %v", d.files.files)
+	}
+	if accessFile.MaxSize != 0 {
+		t.Fatalf("expected the reloaded max size %v but got %v", 0, accessFile.MaxSize)
+	}
+	data, _ := os.ReadFile(logPath)
+	if !strings.Contains(string(data), "late record") || !strings.Contains(string(data), "new record") {
+		t.Fatalf("expected both records in the log but got %q", data)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/startdusk/go-socks"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd
+// socket activation or a handoff.
+const listenFDsStart = 3
+
+// handoffFDsEnv is set by a process handing its listening sockets to
+// a new one, to their number. handoffPIDEnv is the pid of the process
+// to stop once the new one is ready.
+const (
+	handoffFDsEnv = "SOCKS_HANDOFF_FDS"
+	handoffPIDEnv = "SOCKS_HANDOFF_PID"
+)
+
+// listenFDs returns the number and names of the sockets passed by
+// systemd socket activation, see sd_listen_fds(3).
+func listenFDs(getenv func(string) string) (int, []string) {
+	pid, err := strconv.Atoi(getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return 0, nil
+	}
+	names := make([]string, n)
+	copy(names, strings.Split(getenv("LISTEN_FDNAMES"), ":"))
+	return n, names
+}
+
+// inheritedFiles are the listening sockets passed to the process.
+type inheritedFiles struct {
+	files []*os.File
+	names []string
+	// handoff is set if the files come from a previous process,
+	// one per configured listener
+	handoff bool
+}
+
+// inheritFiles takes the sockets passed by systemd or a previous
+// process and clears the environment variables announcing them,
+// so they aren't passed on to children.
+func inheritFiles() *inheritedFiles {
+	inherited := new(inheritedFiles)
+	n, names := listenFDs(os.Getenv)
+	if handoff, err := strconv.Atoi(os.Getenv(handoffFDsEnv)); err == nil && handoff > 0 {
+		n, names, inherited.handoff = handoff, make([]string, handoff), true
+	}
+	for _, key := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", handoffFDsEnv} {
+		os.Unsetenv(key)
+	}
+	for i := 0; i < n; i++ {
+		name := names[i]
+		if name == "" {
+			name = fmt.Sprintf("fd %d", listenFDsStart+i)
+		}
+		inherited.files = append(inherited.files, os.NewFile(uintptr(listenFDsStart+i), name))
+	}
+	inherited.names = names
+	return inherited
+}
+
+// apply sets the inherited sockets as the files of the listeners,
+// which keep their other settings. Handed over sockets are in the
+// order of the listeners. Sockets from systemd are selected by the
+// fd_name of listeners, only a single listener may go without. Sockets
+// which don't match the listeners one-to-one are an error.
+func (in *inheritedFiles) apply(c *fileConfig, listeners []socks.Listener) ([]socks.Listener, error) {
+	if in.handoff {
+		if len(in.files) != len(listeners) {
+			return nil, fmt.Errorf("%d sockets handed over for %d listeners, changing listeners needs a restart", len(in.files), len(listeners))
+		}
+		for i := range listeners {
+			listeners[i].File = in.files[i]
+		}
+		return listeners, nil
+	}
+
+	named := false
+	for i, l := range c.Listeners {
+		if l.FDName == "" {
+			continue
+		}
+		named = true
+		for j, name := range in.names {
+			if name == l.FDName {
+				listeners[i].File = in.files[j]
+			}
+		}
+		if listeners[i].File == nil {
+			return nil, fmt.Errorf("listeners[%d]: no socket named %q passed by systemd", i, l.FDName)
+		}
+	}
+	if named || len(in.files) == 0 {
+		return listeners, nil
+	}
+	if len(in.files) != 1 || len(listeners) != 1 {
+		return nil, fmt.Errorf("%d sockets passed by systemd for %d listeners, select them with fd_name", len(in.files), len(listeners))
+	}
+	listeners[0].File = in.files[0]
+	return listeners, nil
+}
+
+// sdNotify sends a state change to the service manager, see sd_notify(3).
+// It does nothing if the process wasn't started by systemd.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		// abstract socket
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often the service manager expects
+// WATCHDOG=1 messages, 0 if the watchdog is disabled.
+func watchdogInterval(getenv func(string) string) time.Duration {
+	usec, err := strconv.ParseInt(getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/startdusk/go-socks"
+)
+
+func TestListenFDs(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	cases := []struct {
+		name  string
+		env   map[string]string
+		n     int
+		names []string
+	}{
+		{"unset", map[string]string{}, 0, nil},
+		{"other_process", map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "2"}, 0, nil},
+		{"invalid", map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": "x"}, 0, nil},
+		{"unnamed", map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": "2"}, 2, []string{"", ""}},
+		{"named", map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": "2", "LISTEN_FDNAMES": "socks:admin"}, 2, []string{"socks", "admin"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			n, names := listenFDs(func(key string) string { return c.env[key] })
+			if n != c.n || !reflect.DeepEqual(names, c.names) {
+				t.Fatalf("expected %v %v but got %v %v", c.n, c.names, n, names)
+			}
+		})
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	cases := []struct {
+		env    map[string]string
+		expect time.Duration
+	}{
+		{map[string]string{}, 0},
+		{map[string]string{"WATCHDOG_USEC": "30000000"}, 30 * time.Second},
+		{map[string]string{"WATCHDOG_USEC": "30000000", "WATCHDOG_PID": strconv.Itoa(os.Getpid())}, 30 * time.Second},
+		{map[string]string{"WATCHDOG_USEC": "30000000", "WATCHDOG_PID": "1"}, 0},
+	}
+	for _, c := range cases {
+		if got := watchdogInterval(func(key string) string { return c.env[key] }); got != c.expect {
+			t.Fatalf("expected %v for %v but got %v", c.expect, c.env, got)
+		}
+	}
+}
+
+func TestInheritedFilesApply(t *testing.T) {
+	a, b, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	defer a.Close()
+	defer b.Close()
+	c := &fileConfig{Listeners: []listenerConfig{
+		{Address: "127.0.0.1:1080"},
+		{Address: "127.0.0.1:1081", FDName: "admin"},
+	}}
+	configured := func() []socks.Listener {
+		return []socks.Listener{{Address: "127.0.0.1:1080"}, {Address: "127.0.0.1:1081", Profile: "admin"}}
+	}
+	single := &fileConfig{Listen: "127.0.0.1:1080"}
+
+	cases := []struct {
+		name      string
+		inherited *inheritedFiles
+		c         *fileConfig
+		expect    []*os.File
+	}{
+		{"none", &inheritedFiles{}, &fileConfig{}, []*os.File{nil, nil}},
+		{"named", &inheritedFiles{files: []*os.File{a, b}, names: []string{"socks", "admin"}}, c, []*os.File{nil, b}},
+		{"single", &inheritedFiles{files: []*os.File{a}, names: []string{""}}, single, []*os.File{a}},
+		{"handoff", &inheritedFiles{files: []*os.File{a, b}, names: []string{"", ""}, handoff: true}, c, []*os.File{a, b}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			listeners := configured()
+			if tc.c == single {
+				listeners = single.serverListeners()
+			}
+			listeners, err := tc.inherited.apply(tc.c, listeners)
+			if err != nil {
+				t.Fatalf("expected want nil but got error: %+v", err)
+			}
+			files := make([]*os.File, len(listeners))
+			for i, l := range listeners {
+				files[i] = l.File
+			}
+			if !reflect.DeepEqual(files, tc.expect) {
+				t.Fatalf("expected files %v but got %v", tc.expect, files)
+			}
+			if len(listeners) == 2 && listeners[1].Profile != "admin" {
+				t.Fatalf("expected listener settings to be kept but got %+v", listeners[1])
+			}
+		})
+	}
+
+	// Sockets not matching the listeners one-to-one would lose the
+	// listeners' profiles
+	unmatched := []struct {
+		inherited *inheritedFiles
+		c         *fileConfig
+	}{
+		{&inheritedFiles{}, c},
+		{&inheritedFiles{files: []*os.File{a}, names: []string{"socks"}}, c},
+		{&inheritedFiles{files: []*os.File{a, b}, names: []string{"", ""}}, &fileConfig{}},
+		{&inheritedFiles{files: []*os.File{a}, names: []string{""}, handoff: true}, c},
+	}
+	for _, u := range unmatched {
+		if _, err := u.inherited.apply(u.c, configured()); err == nil {
+			t.Fatalf("expected an error for sockets %v but got nil", u.inherited.names)
+		}
+	}
+}
+
+func TestSDNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	if got := string(buf[:n]); got != "READY=1" {
+		t.Fatalf("expected %q but got %q", "READY=1", got)
+	}
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package socks
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+)
+
+const codecReadBufferSize = 1024
+
+// codec reads the handshake of a connection from one buffered reader
+// and writes every reply with a single write. Codecs are pooled so a
+// handshake doesn't allocate buffers.
+type codec struct {
+	r *bufio.Reader
+	w io.Writer
+
+	// buf holds the fields of the message being parsed
+	buf [255]byte
+	// out holds the reply being written
+	out [6 + IPv6Len]byte
+
+	// reply is the reply sent to the request, if replied
+	reply   Reply
+	replied bool
+}
+
+var codecPool = sync.Pool{
+	New: func() interface{} {
+		return &codec{r: bufio.NewReaderSize(nil, codecReadBufferSize)}
+	},
+}
+
+func newCodec(conn io.ReadWriter) *codec {
+	c := codecPool.Get().(*codec)
+	c.r.Reset(conn)
+	c.w = conn
+	return c
+}
+
+func (c *codec) release() {
+	c.r.Reset(nil)
+	c.w = nil
+	c.reply, c.replied = 0, false
+	codecPool.Put(c)
+}
+
+func (c *codec) readProxyHeader() (net.Addr, error) {
+	return readProxyHeader(c.r, c.buf[:])
+}
+
+func (c *codec) readClientAuthMsg(msg *ClientAuthMsg) error {
+	return readClientAuthMsg(c.r, c.buf[:], msg)
+}
+
+func (c *codec) readClientPasswordMsg(msg *ClientPasswordMsg) error {
+	return readClientPasswordMsg(c.r, c.buf[:], msg)
+}
+
+func (c *codec) readClientRequestMsg(msg *ClientRequestMsg) error {
+	return readClientRequestMsg(c.r, c.buf[:], msg)
+}
+
+func (c *codec) writeServerAuthMsg(method Method) error {
+	_, err := c.w.Write(appendServerAuthMsg(c.out[:0], method))
+	return err
+}
+
+func (c *codec) writeSrvPasswordMsg(status byte) error {
+	_, err := c.w.Write(appendSrvPasswordMsg(c.out[:0], status))
+	return err
+}
+
+func (c *codec) writeReqSuccessMsg(ip net.IP, port uint16) error {
+	c.reply, c.replied = ReplySucceeded, true
+	_, err := c.w.Write(appendReqSuccessMsg(c.out[:0], ip, port))
+	return err
+}
+
+func (c *codec) writeReqDomainMsg(host string, port uint16) error {
+	b, err := appendReqDomainMsg(c.out[:0], host, port)
+	if err != nil {
+		return err
+	}
+	c.reply, c.replied = ReplySucceeded, true
+	_, err = c.w.Write(b)
+	return err
+}
+
+func (c *codec) writeReqFailureMsg(reply Reply) error {
+	c.reply, c.replied = reply, true
+	_, err := c.w.Write(appendReqFailureMsg(c.out[:0], reply))
+	return err
+}
+
+// flushTo writes the data the client sent after its request, which
+// was buffered along with the handshake, to w.
+func (c *codec) flushTo(w io.Writer) (int64, error) {
+	n := c.r.Buffered()
+	if n == 0 {
+		return 0, nil
+	}
+	data, err := c.r.Peek(n)
+	if err != nil {
+		return 0, err
+	}
+	n, err = w.Write(data)
+	return int64(n), err
+}
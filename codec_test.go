@@ -0,0 +1,125 @@
+package socks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// handshakeConn replays a handshake and counts the writes of the replies.
+type handshakeConn struct {
+	r      bytes.Reader
+	writes int
+}
+
+func (c *handshakeConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *handshakeConn) Write(p []byte) (int, error) {
+	c.writes++
+	return len(p), nil
+}
+
+func testHandshake(earlyData string) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{SOCKS5Version, 1, MethodPassword})
+	buf.Write([]byte{PasswordMethodVersion, 5})
+	buf.WriteString("admin")
+	buf.Write([]byte{6})
+	buf.WriteString("123456")
+	buf.Write([]byte{SOCKS5Version, CmdConnect, ReservedField, DomainName, 11})
+	buf.WriteString("example.com")
+	buf.Write([]byte{0x01, 0xbb})
+	buf.WriteString(earlyData)
+	return buf.Bytes()
+}
+
+var testPasswordConf = &Config{
+	AuthMethod: MethodPassword,
+	PasswordChecker: func(username, password string) bool {
+		return username == "admin" && password == "123456"
+	},
+}
+
+func TestCodecHandshake(t *testing.T) {
+	conn := new(handshakeConn)
+	conn.r.Reset(testHandshake("GET / HTTP/1.1\r\n"))
+
+	c := newCodec(conn)
+	defer c.release()
+	user, err := auth(c, testPasswordConf)
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	if user != "admin" {
+		t.Fatalf("expected user %v but got %v", "admin", user)
+	}
+	var msg ClientRequestMsg
+	if err := c.readClientRequestMsg(&msg); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	if msg.Address != "example.com" || msg.Port != 443 {
+		t.Fatalf("expected target %v but got %v:%v", "example.com:443", msg.Address, msg.Port)
+	}
+	if err := c.writeReqSuccessMsg(net.IPv4(127, 0, 0, 1), 1080); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	if conn.writes != 3 {
+		t.Fatalf("expected one write per reply, %v writes but got %v", 3, conn.writes)
+	}
+
+	// Data pipelined after the request must reach the target
+	var target bytes.Buffer
+	if _, err := c.flushTo(&target); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	rest, _ := io.ReadAll(&conn.r)
+	got := target.String() + string(rest)
+	if got != "GET / HTTP/1.1\r\n" {
+		t.Fatalf("expected early data %q but got %q", "GET / HTTP/1.1\r\n", got)
+	}
+}
+
+func BenchmarkHandshake(b *testing.B) {
+	data := testHandshake("")
+	ip := net.IPv4(127, 0, 0, 1)
+	conn := new(handshakeConn)
+
+	b.Run("codec", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			conn.r.Reset(data)
+			c := newCodec(conn)
+			if _, err := auth(c, testPasswordConf); err != nil {
+				b.Fatal(err)
+			}
+			var msg ClientRequestMsg
+			if err := c.readClientRequestMsg(&msg); err != nil {
+				b.Fatal(err)
+			}
+			c.writeReqSuccessMsg(ip, 1080)
+			c.release()
+		}
+	})
+
+	b.Run("exported", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			conn.r.Reset(data)
+			if _, err := NewClientAuthMsg(conn); err != nil {
+				b.Fatal(err)
+			}
+			NewServerAuthMsg(conn, MethodPassword)
+			if _, err := NewClientPasswordMsg(conn); err != nil {
+				b.Fatal(err)
+			}
+			WriteSrvPasswordMsg(conn, PasswordAuthSuccess)
+			if _, err := NewClientRequestMsg(conn); err != nil {
+				b.Fatal(err)
+			}
+			WriteReqSuccessMsg(conn, ip, 1080)
+		}
+	})
+}
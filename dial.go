@@ -0,0 +1,166 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+const dialTimeout = 5 * time.Second
+
+var errNoAddresses = errors.New("no addresses resolved")
+
+func (c *Config) resolver() Resolver {
+	if c.Resolver != nil {
+		return c.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// resolveTarget returns the addresses of the request target,
+// looking domain names up through the configured resolver.
+func resolveTarget(ctx context.Context, conf *Config, msg *ClientRequestMsg) ([]net.IPAddr, error) {
+	if msg.AddrType != DomainName {
+		ip := net.ParseIP(msg.Address)
+		if ip == nil {
+			return nil, ErrAddrTypeNotSupported
+		}
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	addrs, err := conf.resolver().LookupIPAddr(ctx, msg.Address)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, errNoAddresses
+	}
+	return addrs, nil
+}
+
+const defaultFallbackDelay = 250 * time.Millisecond
+
+// dialTCP connects to address with d, tests replace it to simulate
+// unresponsive targets.
+var dialTCP = func(ctx context.Context, d *net.Dialer, address string) (net.Conn, error) {
+	return d.DialContext(ctx, "tcp", address)
+}
+
+// dialAddrs connects to the first reachable address. Attempts are
+// staggered by delay and alternate between address families as
+// described in RFC 8305 (Happy Eyeballs v2), so a broken IPv6 path
+// doesn't stall connections to dual-stack targets.
+func dialAddrs(ctx context.Context, outbound *Outbound, addrs []net.IPAddr, port uint16, delay time.Duration) (net.Conn, error) {
+	if delay == 0 {
+		delay = defaultFallbackDelay
+	}
+	if delay < 0 || len(addrs) == 1 {
+		return dialSerial(ctx, outbound, addrs, port)
+	}
+	addrs = interleaveAddrs(addrs)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan dialResult, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		d := outbound.dialer(addrs[next].IP)
+		address := net.JoinHostPort(addrs[next].String(), strconv.Itoa(int(port)))
+		next++
+		pending++
+		go func() {
+			conn, err := dialTCP(ctx, d, address)
+			results <- dialResult{conn, err}
+		}()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	start()
+
+	var firstErr error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(delay)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// Close connections that lost the race
+				go func(n int) {
+					for ; n > 0; n-- {
+						if res := <-results; res.conn != nil {
+							res.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			// Don't wait for the delay after a failure
+			if next < len(addrs) {
+				start()
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(delay)
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+func dialSerial(ctx context.Context, outbound *Outbound, addrs []net.IPAddr, port uint16) (net.Conn, error) {
+	var firstErr error
+	for _, addr := range addrs {
+		d := outbound.dialer(addr.IP)
+		address := net.JoinHostPort(addr.String(), strconv.Itoa(int(port)))
+		conn, err := dialTCP(ctx, d, address)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// interleaveAddrs reorders addrs so address families alternate,
+// starting with the family of the first address (RFC 8305 section 4).
+func interleaveAddrs(addrs []net.IPAddr) []net.IPAddr {
+	var primary, fallback []net.IPAddr
+	firstIsV4 := addrs[0].IP.To4() != nil
+	for _, addr := range addrs {
+		if (addr.IP.To4() != nil) == firstIsV4 {
+			primary = append(primary, addr)
+		} else {
+			fallback = append(fallback, addr)
+		}
+	}
+
+	sorted := make([]net.IPAddr, 0, len(addrs))
+	for i := 0; i < len(primary) || i < len(fallback); i++ {
+		if i < len(primary) {
+			sorted = append(sorted, primary[i])
+		}
+		if i < len(fallback) {
+			sorted = append(sorted, fallback[i])
+		}
+	}
+	return sorted
+}
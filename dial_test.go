@@ -0,0 +1,101 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInterleaveAddrs(t *testing.T) {
+	v4a := net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	v4b := net.IPAddr{IP: net.IPv4(192, 0, 2, 2)}
+	v6a := net.IPAddr{IP: net.ParseIP("2001:db8::1")}
+	v6b := net.IPAddr{IP: net.ParseIP("2001:db8::2")}
+
+	cases := []struct {
+		name   string
+		addrs  []net.IPAddr
+		expect []net.IPAddr
+	}{
+		{
+			name:   "ipv6_first",
+			addrs:  []net.IPAddr{v6a, v6b, v4a, v4b},
+			expect: []net.IPAddr{v6a, v4a, v6b, v4b},
+		},
+		{
+			name:   "ipv4_first",
+			addrs:  []net.IPAddr{v4a, v4b, v6a},
+			expect: []net.IPAddr{v4a, v6a, v4b},
+		},
+		{
+			name:   "single_family",
+			addrs:  []net.IPAddr{v4a, v4b},
+			expect: []net.IPAddr{v4a, v4b},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := interleaveAddrs(c.addrs)
+			if !reflect.DeepEqual(got, c.expect) {
+				t.Fatalf("expected addrs %v but got %v", c.expect, got)
+			}
+		})
+	}
+}
+
+func TestDialAddrsFallback(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	port := uint16(lis.Addr().(*net.TCPAddr).Port)
+
+	// The IPv6 target never answers, the IPv4 attempt started after
+	// the fallback delay must win
+	stalled := make(chan error, 1)
+	defer func(dial func(context.Context, *net.Dialer, string) (net.Conn, error)) { dialTCP = dial }(dialTCP)
+	dialTCP = func(ctx context.Context, d *net.Dialer, address string) (net.Conn, error) {
+		if host, _, _ := net.SplitHostPort(address); host == "::1" {
+			<-ctx.Done()
+			stalled <- ctx.Err()
+			return nil, ctx.Err()
+		}
+		return d.DialContext(ctx, "tcp", address)
+	}
+
+	addrs := []net.IPAddr{
+		{IP: net.IPv6loopback},
+		{IP: net.IPv4(127, 0, 0, 1)},
+	}
+	delay := 50 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	conn, err := dialAddrs(ctx, nil, addrs, port, delay)
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	defer conn.Close()
+
+	got := conn.RemoteAddr().(*net.TCPAddr).IP
+	if !got.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("expected remote address %v but got %v", net.IPv4(127, 0, 0, 1), got)
+	}
+	if elapsed < delay || elapsed > time.Second {
+		t.Fatalf("expected to connect after about %v but took %v", delay, elapsed)
+	}
+	// The losing attempt is canceled
+	select {
+	case err := <-stalled:
+		if err != context.Canceled {
+			t.Fatalf("expected want error %v but got %v", context.Canceled, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the IPv6 attempt to be canceled")
+	}
+}
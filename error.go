@@ -8,6 +8,8 @@ var (
 	ErrCommandNotSupported       = errors.New("request command not supported")
 	ErrInvalidReservedField      = errors.New("protocol reserved invalid")
 	ErrAddrTypeNotSupported      = errors.New("address type not supported")
+	ErrDomainNameTooLong         = errors.New("domain name longer than 255 bytes")
+	ErrReverseLookupNotSupported = errors.New("resolver does not support reverse lookups")
 
 	ErrMethodsLengthZero  = errors.New("methods length 0")
 	ErrUsernameLengthZero = errors.New("username length 0")
@@ -15,4 +17,35 @@ var (
 
 	ErrPasswordAuthFailure   = errors.New("error authenticating username or password")
 	ErrPasswordCheckerNotSet = errors.New("password checker not set")
+	ErrNoAcceptableMethod    = errors.New("no acceptable authentication method")
+
+	ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+	ErrHandshakeTimeout        = errors.New("handshake timeout")
+	ErrIdleTimeout             = errors.New("tunnel idle timeout")
+	ErrSessionLifetimeExceeded = errors.New("session lifetime exceeded")
+
+	ErrSessionLimit       = errors.New("too many sessions")
+	ErrClientSessionLimit = errors.New("too many sessions from client")
+	ErrUserSessionLimit   = errors.New("too many sessions of user")
+
+	ErrQuotaExceeded = errors.New("traffic quota exceeded")
+
+	ErrServerDraining   = errors.New("server draining")
+	ErrSessionClosed    = errors.New("session closed by administrator")
+	ErrAdminTokenNotSet = errors.New("admin API token not set")
+
+	ErrServerClosed       = errors.New("server closed")
+	ErrServerNotListening = errors.New("server not listening")
+	ErrUnknownProfile     = errors.New("listener profile not configured")
+	ErrListenerNotFile    = errors.New("listener has no file")
+
+	ErrInvalidTransparentListener = errors.New("transparent listener needs a TCP network and a mode of redirect or tproxy")
+	ErrTransparentNotSupported    = errors.New("transparent proxy mode not supported on this platform")
+	ErrNoOriginalDst              = errors.New("no original destination")
+
+	ErrInvalidOutbound          = errors.New("outbound needs at most one local IPv4 and one local IPv6 address")
+	ErrNoOutboundAddr           = errors.New("no outbound address for target address family")
+	ErrBindToDeviceNotSupported = errors.New("binding to a network interface not supported on this platform")
+	ErrProxyHeaderVersion       = errors.New("PROXY protocol header version must be 1 or 2")
 )
@@ -0,0 +1,117 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Forwarder accepts connections on a local address and tunnels each
+// of them to a fixed remote address through a SOCKS5 server, like
+// ssh -L does through an SSH server.
+type Forwarder struct {
+	// Listen is the local host:port.
+	Listen string
+	// Remote is the host:port the SOCKS5 server connects to.
+	Remote string
+	// Dialer connects through the SOCKS5 server.
+	Dialer *Dialer
+
+	// Logger receives the log records of the forwarder. If nil,
+	// records of level info and above are written to the standard logger.
+	Logger Logger
+
+	mu     sync.Mutex
+	lis    net.Listener
+	closed bool
+}
+
+// ListenAndServe listens on f.Listen and forwards its connections
+// until Close is called, then returns ErrServerClosed.
+func (f *Forwarder) ListenAndServe() error {
+	lis, err := net.Listen("tcp", f.Listen)
+	if err != nil {
+		return err
+	}
+	return f.Serve(lis)
+}
+
+// Serve forwards the connections of lis until Close is called,
+// then returns ErrServerClosed.
+func (f *Forwarder) Serve(lis net.Listener) error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		lis.Close()
+		return ErrServerClosed
+	}
+	f.lis = lis
+	f.mu.Unlock()
+
+	logger := (&Config{Logger: f.Logger}).logger()
+	logger.Info("forwarding", "addr", lis.Addr().String(), "remote", f.Remote, "server", f.Dialer.Server)
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return ErrServerClosed
+			}
+			logger.Error("accept failure", "addr", lis.Addr().String(), "error", err)
+			continue
+		}
+		go f.forward(conn, logger)
+	}
+}
+
+// Addr returns the address the forwarder is listening on, nil
+// before Serve.
+func (f *Forwarder) Addr() net.Addr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.lis == nil {
+		return nil
+	}
+	return f.lis.Addr()
+}
+
+// Close closes the listener. Open connections are not interrupted.
+func (f *Forwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	if f.lis == nil {
+		return nil
+	}
+	return f.lis.Close()
+}
+
+func (f *Forwarder) forward(conn net.Conn, logger Logger) {
+	defer conn.Close()
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	remote, err := f.Dialer.DialContext(ctx, "tcp", f.Remote)
+	cancel()
+	if err != nil {
+		logger.Warn("forward failed", "client", conn.RemoteAddr().String(), "remote", f.Remote, "error", err)
+		return
+	}
+
+	stats, err := forward(conn, remote, &tunnel{
+		timeouts:  newTunnelTimeouts(&Config{}, start),
+		bandwidth: new(tunnelBandwidth),
+	})
+	args := []any{
+		"client", conn.RemoteAddr().String(),
+		"remote", f.Remote,
+		"duration", time.Since(start),
+		"up", stats.Upload,
+		"down", stats.Download,
+	}
+	if err != nil {
+		logger.Warn("forward failed", append(args, "error", err)...)
+		return
+	}
+	logger.Info("forward closed", args...)
+}
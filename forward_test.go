@@ -0,0 +1,79 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestForwarder(t *testing.T) {
+	echo := echoServer(t)
+	conf := *testPasswordConf
+	s := testServer(t, &conf)
+
+	f := &Forwarder{
+		Remote: echo.Addr().String(),
+		Dialer: &Dialer{Server: s.Addrs()[0].String(), Username: "admin", Password: "123456"},
+		Logger: DiscardLogger,
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- f.Serve(lis) }()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			t.Fatalf("expected want nil but got error: %+v", err)
+		}
+		conn.Write([]byte("ping"))
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+			t.Fatalf("expected %q but got %q and %v", "ping", got, err)
+		}
+		conn.Close()
+	}
+
+	if f.Addr().String() != lis.Addr().String() {
+		t.Fatalf("expected to listen on %v but got %v", lis.Addr(), f.Addr())
+	}
+	f.Close()
+	if err := <-errc; err != ErrServerClosed {
+		t.Fatalf("expected want error %v but got %v", ErrServerClosed, err)
+	}
+	if err := f.Serve(lis); err != ErrServerClosed {
+		t.Fatalf("expected want error %v but got %v", ErrServerClosed, err)
+	}
+}
+
+func TestForwarderDialFailure(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	closed.Close()
+
+	f := &Forwarder{
+		Remote: "example.com:80",
+		Dialer: &Dialer{Server: closed.Addr().String()},
+		Logger: DiscardLogger,
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	go f.Serve(lis)
+	defer f.Close()
+
+	// The client connection is closed
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	defer conn.Close()
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Fatalf("expected connection to be closed but read %v bytes and %v", n, err)
+	}
+}
@@ -0,0 +1,111 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Hooks are callbacks invoked at the stages of every session. They run
+// on the session's goroutine, so slow hooks delay the session. The
+// context passed to them is canceled when the session ends.
+type Hooks struct {
+	// OnAccept is called before the handshake. Returning an error
+	// closes the connection without a reply.
+	OnAccept func(ctx context.Context, info SessionInfo) error
+
+	// OnAuth is called with the result of the authentication.
+	OnAuth func(ctx context.Context, info SessionInfo, err error)
+
+	// OnRequest is called before the target is resolved. It may rewrite
+	// the target by changing req.Address and req.Port, or veto the request
+	// by returning an error, which is answered with
+	// ReplyConnectionNotAllowedByRuleset.
+	OnRequest func(ctx context.Context, info SessionInfo, req *ClientRequestMsg) error
+
+	// OnDial is called with the result of connecting to the target.
+	// On success info.Remote is the address of the target connection.
+	OnDial func(ctx context.Context, info SessionInfo, err error)
+
+	// OnClose is called when the session ends, err being the reason
+	// it failed if any.
+	OnClose func(ctx context.Context, info SessionInfo, stats RelayStats, err error)
+}
+
+// SessionInfo describes a session to hooks.
+type SessionInfo struct {
+	ID     uint64
+	Client net.Addr
+	Start  time.Time
+	// User is the authenticated username, empty without authentication
+	User string
+	// Target is the requested host:port, empty before the request is read
+	Target string
+	// Remote is the address of the target connection, nil before dialing
+	Remote net.Addr
+	// Upload and Download are the bytes relayed so far
+	Upload   int64
+	Download int64
+}
+
+// hookError is an error returned by a hook vetoing a session.
+type hookError struct {
+	err error
+}
+
+func (e *hookError) Error() string { return e.err.Error() }
+func (e *hookError) Unwrap() error { return e.err }
+
+func (h *Hooks) accept(sess *session) error {
+	if h.OnAccept == nil {
+		return nil
+	}
+	if err := h.OnAccept(sess.ctx, sess.info()); err != nil {
+		return &hookError{err}
+	}
+	return nil
+}
+
+func (h *Hooks) auth(sess *session, err error) {
+	if h.OnAuth != nil {
+		h.OnAuth(sess.ctx, sess.info(), err)
+	}
+}
+
+func (h *Hooks) request(sess *session, msg *ClientRequestMsg) error {
+	if h.OnRequest == nil {
+		return nil
+	}
+	address := msg.Address
+	if err := h.OnRequest(sess.ctx, sess.info(), msg); err != nil {
+		return &hookError{err}
+	}
+	if msg.Address != address {
+		msg.AddrType = hostAddrType(msg.Address)
+	}
+	return nil
+}
+
+func (h *Hooks) dial(sess *session, err error) {
+	if h.OnDial != nil {
+		h.OnDial(sess.ctx, sess.info(), err)
+	}
+}
+
+func (h *Hooks) close(sess *session, err error) {
+	if h.OnClose != nil {
+		h.OnClose(sess.ctx, sess.info(), sess.stats, err)
+	}
+}
+
+// hostAddrType returns the request address type of a host.
+func hostAddrType(host string) AddressType {
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return DomainName
+	case ip.To4() != nil:
+		return IPv4Addr
+	}
+	return IPv6Addr
+}
@@ -0,0 +1,191 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// hookRecorder records the hook invocations of sessions.
+type hookRecorder struct {
+	mu     sync.Mutex
+	events []string
+	info   SessionInfo
+	stats  RelayStats
+	err    error
+}
+
+func (r *hookRecorder) record(event string, info SessionInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+	r.info = info
+}
+
+func (r *hookRecorder) hooks() Hooks {
+	return Hooks{
+		OnAccept: func(ctx context.Context, info SessionInfo) error {
+			r.record("accept", info)
+			return nil
+		},
+		OnAuth: func(ctx context.Context, info SessionInfo, err error) {
+			r.record("auth", info)
+		},
+		OnRequest: func(ctx context.Context, info SessionInfo, req *ClientRequestMsg) error {
+			r.record("request", info)
+			return nil
+		},
+		OnDial: func(ctx context.Context, info SessionInfo, err error) {
+			r.record("dial", info)
+		},
+		OnClose: func(ctx context.Context, info SessionInfo, stats RelayStats, err error) {
+			r.record("close", info)
+			r.stats, r.err = stats, err
+			if ctx.Err() != nil {
+				r.err = ctx.Err()
+			}
+		},
+	}
+}
+
+// runHookSession serves one session sending the test handshake with
+// early data and returns everything the server wrote back.
+func runHookSession(t *testing.T, conf *Config) []byte {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	done := make(chan struct{})
+	go func() {
+		new(Server).serveConn(server, conf)
+		close(done)
+	}()
+	go client.Write(testHandshake("ping"))
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	<-done
+	return got
+}
+
+func TestHooks(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.ReadFull(conn, make([]byte, 4))
+		conn.Write([]byte("pong"))
+	}()
+	targetAddr := lis.Addr().(*net.TCPAddr)
+
+	rec := new(hookRecorder)
+	conf := *testPasswordConf
+	conf.Hooks = rec.hooks()
+	onRequest := conf.Hooks.OnRequest
+	conf.Hooks.OnRequest = func(ctx context.Context, info SessionInfo, req *ClientRequestMsg) error {
+		if info.Target != "example.com:443" {
+			t.Errorf("expected target %v but got %v", "example.com:443", info.Target)
+		}
+		req.Address, req.Port = targetAddr.IP.String(), uint16(targetAddr.Port)
+		return onRequest(ctx, info, req)
+	}
+
+	got := runHookSession(t, &conf)
+	if n := len(got); n < 14 || string(got[n-4:]) != "pong" {
+		t.Fatalf("expected tunnel to answer %q but got %q", "pong", got)
+	}
+
+	expect := []string{"accept", "auth", "request", "dial", "close"}
+	if !reflect.DeepEqual(rec.events, expect) {
+		t.Fatalf("expected hooks %v but got %v", expect, rec.events)
+	}
+	target := net.JoinHostPort(targetAddr.IP.String(), strconv.Itoa(targetAddr.Port))
+	if rec.info.User != "admin" || rec.info.Target != target || rec.info.Remote.String() != target {
+		t.Fatalf("expected session of %v to %v but got %+v", "admin", target, rec.info)
+	}
+	if rec.err != nil {
+		t.Fatalf("expected want nil but got error: %+v", rec.err)
+	}
+	if rec.stats.Upload != 4 || rec.stats.Download != 4 {
+		t.Fatalf("expected %v bytes each way but got %+v", 4, rec.stats)
+	}
+}
+
+func TestHooksVeto(t *testing.T) {
+	errVeto := errors.New("vetoed")
+	cases := []struct {
+		name   string
+		hooks  func(h *Hooks)
+		events []string
+		reply  []byte
+	}{
+		{
+			name: "accept",
+			hooks: func(h *Hooks) {
+				h.OnAccept = func(ctx context.Context, info SessionInfo) error {
+					return errVeto
+				}
+			},
+			events: []string{"close"},
+		},
+		{
+			name: "request",
+			hooks: func(h *Hooks) {
+				h.OnRequest = func(ctx context.Context, info SessionInfo, req *ClientRequestMsg) error {
+					return errVeto
+				}
+			},
+			events: []string{"accept", "auth", "close"},
+			reply: []byte{
+				SOCKS5Version, MethodPassword,
+				PasswordMethodVersion, PasswordAuthSuccess,
+				SOCKS5Version, ReplyConnectionNotAllowedByRuleset, ReservedField, IPv4Addr, 0, 0, 0, 0, 0, 0,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rec := new(hookRecorder)
+			conf := *testPasswordConf
+			conf.Hooks = rec.hooks()
+			c.hooks(&conf.Hooks)
+
+			got := runHookSession(t, &conf)
+			if !reflect.DeepEqual(got, c.reply) && len(got)+len(c.reply) != 0 {
+				t.Fatalf("expected reply %v but got %v", c.reply, got)
+			}
+			if !reflect.DeepEqual(rec.events, c.events) {
+				t.Fatalf("expected hooks %v but got %v", c.events, rec.events)
+			}
+			if !errors.Is(rec.err, errVeto) {
+				t.Fatalf("expected want error %v but got %v", errVeto, rec.err)
+			}
+		})
+	}
+}
+
+func TestHostAddrType(t *testing.T) {
+	cases := map[string]AddressType{
+		"127.0.0.1":   IPv4Addr,
+		"::1":         IPv6Addr,
+		"example.com": DomainName,
+	}
+	for host, expect := range cases {
+		if got := hostAddrType(host); got != expect {
+			t.Fatalf("expected %v type %v but got %v", host, expect, got)
+		}
+	}
+}
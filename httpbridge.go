@@ -0,0 +1,130 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+)
+
+// HTTPBridge is an HTTP proxy handler which makes its connections
+// through a SOCKS5 server, for clients only speaking HTTP proxies.
+// CONNECT requests are tunneled, other requests must have an absolute
+// URL and are forwarded.
+type HTTPBridge struct {
+	// Dialer connects through the SOCKS5 server.
+	Dialer *Dialer
+
+	// Logger receives the log records of the bridge. If nil, records
+	// of level info and above are written to the standard logger.
+	Logger Logger
+
+	once  sync.Once
+	proxy *httputil.ReverseProxy
+}
+
+func (b *HTTPBridge) init() {
+	b.proxy = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			// the bridge doesn't reveal the client
+			r.Header["X-Forwarded-For"] = nil
+		},
+		Transport: &http.Transport{
+			DialContext:         b.Dialer.DialContext,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		ErrorLog: log.New(logWriter{b.logger()}, "", 0),
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			b.logger().Warn("bridge request failed", "client", r.RemoteAddr, "url", r.URL.String(), "error", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		},
+	}
+}
+
+func (b *HTTPBridge) logger() Logger {
+	return (&Config{Logger: b.Logger}).logger()
+}
+
+func (b *HTTPBridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.once.Do(b.init)
+	if r.Method == http.MethodConnect {
+		b.connect(w, r)
+		return
+	}
+	if !r.URL.IsAbs() || r.URL.Scheme != "http" && r.URL.Scheme != "https" {
+		http.Error(w, "absolute http URL required", http.StatusBadRequest)
+		return
+	}
+	b.proxy.ServeHTTP(w, r)
+}
+
+// connect tunnels the connection of a CONNECT request to its host.
+func (b *HTTPBridge) connect(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	logger := b.logger()
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "tunneling not supported", http.StatusInternalServerError)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), dialTimeout)
+	remote, err := b.Dialer.DialContext(ctx, "tcp", r.Host)
+	cancel()
+	if err != nil {
+		logger.Warn("bridge tunnel failed", "client", r.RemoteAddr, "target", r.Host, "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		remote.Close()
+		logger.Warn("bridge tunnel failed", "client", r.RemoteAddr, "target", r.Host, "error", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		remote.Close()
+		return
+	}
+	// the client may have sent data after the request
+	if n := rw.Reader.Buffered(); n > 0 {
+		data, _ := rw.Reader.Peek(n)
+		if _, err := remote.Write(data); err != nil {
+			remote.Close()
+			return
+		}
+	}
+
+	stats, err := forward(conn, remote, &tunnel{
+		timeouts:  newTunnelTimeouts(&Config{}, start),
+		bandwidth: new(tunnelBandwidth),
+	})
+	args := []any{
+		"client", r.RemoteAddr,
+		"target", r.Host,
+		"duration", time.Since(start),
+		"up", stats.Upload,
+		"down", stats.Download,
+	}
+	if err != nil {
+		logger.Warn("bridge tunnel failed", append(args, "error", err)...)
+		return
+	}
+	logger.Debug("bridge tunnel closed", args...)
+}
+
+// logWriter writes the lines of a log.Logger as error records.
+type logWriter struct {
+	logger Logger
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.logger.Error(string(bytes.TrimSuffix(p, []byte("\n"))))
+	return len(p), nil
+}
@@ -0,0 +1,75 @@
+package socks
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestHTTPBridge(t *testing.T) {
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %q", r.Method, r.URL.Path, r.Header.Get("X-Forwarded-For"))
+	})
+	plain := httptest.NewServer(target)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(target)
+	defer secure.Close()
+
+	conf := *testPasswordConf
+	s := testServer(t, &conf)
+	bridge := httptest.NewServer(&HTTPBridge{
+		Dialer: &Dialer{Server: s.Addrs()[0].String(), Username: "admin", Password: "123456"},
+		Logger: DiscardLogger,
+	})
+	defer bridge.Close()
+	proxyURL, _ := url.Parse(bridge.URL)
+
+	client := secure.Client()
+	client.Transport.(*http.Transport).Proxy = http.ProxyURL(proxyURL)
+	for _, target := range []string{plain.URL, secure.URL} {
+		resp, err := client.Get(target + "/ping")
+		if err != nil {
+			t.Fatalf("expected want nil but got error: %+v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != `GET /ping ""` {
+			t.Fatalf("expected %v from %v but got %v %q", http.StatusOK, target, resp.StatusCode, body)
+		}
+	}
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	closed.Close()
+	cases := []struct {
+		method string
+		target string
+		code   int
+	}{
+		{http.MethodGet, "/relative", http.StatusBadRequest},
+		{http.MethodGet, "http://" + closed.Addr().String() + "/", http.StatusBadGateway},
+		{http.MethodConnect, closed.Addr().String(), http.StatusBadGateway},
+	}
+	for _, c := range cases {
+		conn, err := net.Dial("tcp", bridge.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("expected want nil but got error: %+v", err)
+		}
+		fmt.Fprintf(conn, "%s %s HTTP/1.1\r\nHost: %s\r\n\r\n", c.method, c.target, closed.Addr())
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("expected want nil but got error: %+v", err)
+		}
+		if resp.StatusCode != c.code {
+			t.Fatalf("expected %v %v to answer %v but got %v", c.method, c.target, c.code, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package socks
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Limits bounds the number of concurrent sessions.
+// Zero values mean no limit.
+type Limits struct {
+	MaxSessions          int
+	MaxSessionsPerClient int
+	MaxSessionsPerUser   int
+
+	// QueueTimeout is how long a session waits for a free slot before
+	// it is rejected. Zero rejects immediately. When queueing, the server
+	// stops accepting connections while MaxSessions is reached, leaving
+	// them in the listen backlog. It should be shorter than HandshakeTimeout.
+	QueueTimeout time.Duration
+}
+
+type limitKind byte
+
+const (
+	limitSessions limitKind = iota
+	limitClient
+	limitUser
+)
+
+type limitKey struct {
+	kind limitKind
+	key  string
+}
+
+// sessionLimiter counts the active sessions, in total, per client IP
+// and per user. The zero value is ready to use.
+type sessionLimiter struct {
+	mu     sync.Mutex
+	counts map[limitKey]int
+
+	// changed is closed and replaced whenever a slot is released
+	changed chan struct{}
+}
+
+// acquire takes a slot for key if less than max are taken, waiting up
+// to wait for one to be released. A max <= 0 means no limit.
+func (l *sessionLimiter) acquire(key limitKey, max int, wait time.Duration) bool {
+	var timer *time.Timer
+	for {
+		l.mu.Lock()
+		if l.counts == nil {
+			l.counts = make(map[limitKey]int)
+		}
+		if max <= 0 || l.counts[key] < max {
+			l.counts[key]++
+			l.mu.Unlock()
+			if timer != nil {
+				timer.Stop()
+			}
+			return true
+		}
+		if wait <= 0 {
+			l.mu.Unlock()
+			return false
+		}
+		changed := l.changedLocked()
+		l.mu.Unlock()
+
+		if timer == nil {
+			timer = time.NewTimer(wait)
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+func (l *sessionLimiter) release(key limitKey) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts[key] <= 1 {
+		delete(l.counts, key)
+	} else {
+		l.counts[key]--
+	}
+	if l.changed != nil {
+		close(l.changed)
+		l.changed = nil
+	}
+}
+
+// waitBelow blocks until less than max slots of key are taken, or
+// done is closed.
+func (l *sessionLimiter) waitBelow(key limitKey, max int, done <-chan struct{}) {
+	for {
+		l.mu.Lock()
+		if max <= 0 || l.counts[key] < max {
+			l.mu.Unlock()
+			return
+		}
+		changed := l.changedLocked()
+		l.mu.Unlock()
+		select {
+		case <-changed:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (l *sessionLimiter) changedLocked() chan struct{} {
+	if l.changed == nil {
+		l.changed = make(chan struct{})
+	}
+	return l.changed
+}
+
+// count returns the number of taken slots of key.
+func (l *sessionLimiter) count(key limitKey) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.counts[key]
+}
+
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,143 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSessionLimiter(t *testing.T) {
+	cases := []struct {
+		name    string
+		max     int
+		taken   int
+		wait    time.Duration
+		release bool
+		expect  bool
+	}{
+		{
+			name:   "no_limit",
+			max:    0,
+			taken:  10,
+			expect: true,
+		},
+		{
+			name:   "below_limit",
+			max:    2,
+			taken:  1,
+			expect: true,
+		},
+		{
+			name:   "reject_immediately",
+			max:    2,
+			taken:  2,
+			expect: false,
+		},
+		{
+			name:   "queue_timeout",
+			max:    1,
+			taken:  1,
+			wait:   20 * time.Millisecond,
+			expect: false,
+		},
+		{
+			name:    "queue_released",
+			max:     1,
+			taken:   1,
+			wait:    time.Second,
+			release: true,
+			expect:  true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var l sessionLimiter
+			key := limitKey{limitClient, "127.0.0.1"}
+			for i := 0; i < c.taken; i++ {
+				l.acquire(key, 0, 0)
+			}
+			if c.release {
+				time.AfterFunc(20*time.Millisecond, func() { l.release(key) })
+			}
+
+			got := l.acquire(key, c.max, c.wait)
+			if got != c.expect {
+				t.Fatalf("expected acquire %v but got %v", c.expect, got)
+			}
+		})
+	}
+}
+
+func TestHandleConnSessionLimit(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	s := new(Server)
+	conf := &Config{Limits: Limits{MaxSessions: 1}}
+	key := limitKey{kind: limitSessions}
+	s.limiter.acquire(key, 0, 0)
+
+	errc := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		errc <- s.handleConn(newSession(1, server), conf)
+	}()
+
+	client.Write([]byte{SOCKS5Version, 1, MethodNoAuth})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	client.Write([]byte{SOCKS5Version, CmdConnect, ReservedField, IPv4Addr, 127, 0, 0, 1, 0, 80})
+	reply = make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+
+	expect := []byte{SOCKS5Version, ReplyGeneralSOCKSServerFailure, ReservedField, IPv4Addr, 0, 0, 0, 0, 0, 0}
+	if !reflect.DeepEqual(reply, expect) {
+		t.Fatalf("expected reply %v but got %v", expect, reply)
+	}
+	if err := <-errc; err != ErrSessionLimit {
+		t.Fatalf("expected want error %v but got %v", ErrSessionLimit, err)
+	}
+	if n := s.limiter.count(key); n != 1 {
+		t.Fatalf("expected %v sessions but got %v", 1, n)
+	}
+}
+
+func TestServerCloseWhileQueueing(t *testing.T) {
+	echo := echoServer(t)
+	s := &Server{
+		Listeners: []Listener{{Address: "127.0.0.1:0"}},
+		Config:    &Config{Logger: DiscardLogger, Limits: Limits{MaxSessions: 1, QueueTimeout: time.Minute}},
+	}
+	errc := waitListening(t, s, 1)
+	addr := s.Addrs()[0].String()
+
+	// The first session takes the only slot, the second one waits
+	// in the listen backlog
+	conn, err := (&Dialer{Server: addr}).Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	defer conn.Close()
+	queued, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	defer queued.Close()
+
+	s.Close()
+	select {
+	case err := <-errc:
+		if err != ErrServerClosed {
+			t.Fatalf("expected want error %v but got %v", ErrServerClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected Serve to return after Close")
+	}
+}
@@ -0,0 +1,257 @@
+package socks
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+)
+
+// Listener is an address the server accepts connections on.
+type Listener struct {
+	// Network is "tcp", "tcp4", "tcp6" or "unix", default "tcp".
+	Network string
+	// Address is the host:port, or the path of a unix socket.
+	// A stale socket file left at the path is removed.
+	Address string
+
+	// File is an inherited listening socket. If set, it is used
+	// instead of Network and Address.
+	File *os.File
+
+	// Profile names the entry of Config.Profiles used for the
+	// sessions of this listener, the Config itself if empty.
+	Profile string
+
+	// Transparent is TransparentRedirect or TransparentTProxy to accept
+	// connections redirected by iptables instead of SOCKS clients, and
+	// tunnel them to their original destination. Their sessions have
+	// no authentication, request and reply, but go through the hooks,
+	// limits and outbound settings like CONNECT requests. Linux only.
+	Transparent string
+}
+
+// Profile overrides the authentication and outbound settings of
+// the sessions accepted by a listener.
+type Profile struct {
+	AuthMethod      Method
+	PasswordChecker func(username, password string) bool
+
+	// Outbound replaces Config.Outbound if set.
+	Outbound *Outbound
+}
+
+func (p *Profile) validate() error {
+	if p.AuthMethod == MethodPassword && p.PasswordChecker == nil {
+		return ErrPasswordCheckerNotSet
+	}
+	return p.Outbound.validate()
+}
+
+// profile returns the configuration of sessions using the named profile.
+func (conf *Config) profile(name string) *Config {
+	p, ok := conf.Profiles[name]
+	if name == "" || !ok {
+		return conf
+	}
+	c := *conf
+	c.AuthMethod, c.PasswordChecker = p.AuthMethod, p.PasswordChecker
+	if p.Outbound != nil {
+		c.Outbound = p.Outbound
+	}
+	return &c
+}
+
+// listenerConfigs returns the listeners of the server, IP:Port if
+// none are configured.
+func (s *Server) listenerConfigs() []Listener {
+	if len(s.Listeners) > 0 {
+		return s.Listeners
+	}
+	return []Listener{{Address: net.JoinHostPort(s.IP, s.Port)}}
+}
+
+// checkProfiles verifies that conf has the profiles of all listeners.
+func (s *Server) checkProfiles(conf *Config) error {
+	for _, l := range s.listenerConfigs() {
+		if _, ok := conf.Profiles[l.Profile]; l.Profile != "" && !ok {
+			return ErrUnknownProfile
+		}
+	}
+	return nil
+}
+
+func (l *Listener) network() string {
+	if l.Network == "" {
+		return "tcp"
+	}
+	return l.Network
+}
+
+func (l *Listener) listen() (net.Listener, error) {
+	if l.Transparent != "" {
+		return l.listenTransparent()
+	}
+	if l.File != nil {
+		return net.FileListener(l.File)
+	}
+	if l.network() == "unix" {
+		if err := removeStaleSocket(l.Address); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen(l.network(), l.Address)
+}
+
+// removeStaleSocket removes the socket file at path, unless a server
+// is listening on it.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// listenAll opens the listeners of the server, closing them all if
+// one fails.
+func (s *Server) listenAll() ([]net.Listener, error) {
+	configs := s.listenerConfigs()
+	listeners := make([]net.Listener, 0, len(configs))
+	for i := range configs {
+		lis, err := configs[i].listen()
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, lis)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		closeListeners(listeners)
+		return nil, ErrServerClosed
+	}
+	s.listeners = listeners
+	return listeners, nil
+}
+
+// Addrs returns the addresses the server is listening on.
+func (s *Server) Addrs() []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := make([]net.Addr, len(s.listeners))
+	for i, lis := range s.listeners {
+		addrs[i] = lis.Addr()
+	}
+	return addrs
+}
+
+// ListenerFiles returns duplicates of the listening sockets, in the
+// order of the listeners, to hand them over to another process.
+// Once that process serves them, KeepSocketFiles must be called
+// before Close so the Unix socket files aren't removed.
+func (s *Server) ListenerFiles() ([]*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files := make([]*os.File, 0, len(s.listeners))
+	for _, lis := range s.listeners {
+		filer, ok := lis.(interface{ File() (*os.File, error) })
+		if !ok {
+			closeFiles(files)
+			return nil, ErrListenerNotFile
+		}
+		f, err := filer.File()
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// KeepSocketFiles keeps the Unix socket files of the listeners when
+// the server closes, as another process took them over.
+func (s *Server) KeepSocketFiles() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, lis := range s.listeners {
+		if unix, ok := lis.(*net.UnixListener); ok {
+			unix.SetUnlinkOnClose(false)
+		}
+	}
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// Close closes the listeners of the server, including those of the
+// metrics and admin API, making Run return ErrServerClosed. Open
+// sessions are not interrupted.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.doneLocked())
+	}
+	for _, srv := range s.httpServers {
+		srv.Close()
+	}
+	return closeListeners(s.listeners)
+}
+
+// done returns a channel closed when the server is closed.
+func (s *Server) done() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.doneLocked()
+}
+
+func (s *Server) doneLocked() chan struct{} {
+	if s.doneCh == nil {
+		s.doneCh = make(chan struct{})
+	}
+	return s.doneCh
+}
+
+func closeListeners(listeners []net.Listener) error {
+	var err error
+	for _, lis := range listeners {
+		if cerr := lis.Close(); cerr != nil && err == nil && !errors.Is(cerr, net.ErrClosed) {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// serve accepts the connections of lis until it is closed.
+func (s *Server) serve(lis net.Listener, profile string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	done := s.done()
+	for {
+		conf := s.config()
+		if conf.Limits.QueueTimeout > 0 {
+			s.limiter.waitBelow(limitKey{kind: limitSessions}, conf.Limits.MaxSessions, done)
+		}
+		conn, err := lis.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			conf.logger().Error("accept failure", "addr", lis.Addr().String(), "error", err)
+			continue
+		}
+
+		go s.serveConn(conn, s.config().profile(profile))
+	}
+}
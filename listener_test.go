@@ -0,0 +1,174 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// waitListening runs s and waits until it listens on all its addresses.
+func waitListening(t *testing.T, s *Server, n int) <-chan error {
+	errc := make(chan error, 1)
+	go func() { errc <- s.Run() }()
+	for i := 0; len(s.Addrs()) < n; i++ {
+		select {
+		case err := <-errc:
+			t.Fatalf("expected want nil but got error: %+v", err)
+		case <-time.After(time.Millisecond):
+		}
+		if i == 1000 {
+			t.Fatalf("expected %v listeners but got %v", n, s.Addrs())
+		}
+	}
+	return errc
+}
+
+func TestServerListeners(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "socks.sock")
+	// A stale socket file is removed
+	stale, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	inherited, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	file, err := inherited.(*net.TCPListener).File()
+	inherited.Close()
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	defer file.Close()
+
+	s := &Server{
+		Listeners: []Listener{
+			{Network: "tcp4", Address: "127.0.0.1:0"},
+			{Network: "unix", Address: sock, Profile: "local"},
+			{File: file, Profile: "local"},
+		},
+		Config: &Config{
+			Logger: DiscardLogger,
+			Profiles: map[string]*Profile{
+				"local": {
+					AuthMethod:      MethodPassword,
+					PasswordChecker: testPasswordConf.PasswordChecker,
+				},
+			},
+		},
+	}
+	errc := waitListening(t, s, 3)
+
+	for i, expect := range []Method{MethodNoAuth, MethodPassword, MethodPassword} {
+		addr := s.Addrs()[i]
+		conn, err := net.Dial(addr.Network(), addr.String())
+		if err != nil {
+			t.Fatalf("expected want nil but got error: %+v", err)
+		}
+		conn.Write([]byte{SOCKS5Version, 2, MethodNoAuth, MethodPassword})
+		reply := make([]byte, 2)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("expected want nil but got error: %+v", err)
+		}
+		conn.Close()
+		if got := []byte{SOCKS5Version, expect}; !reflect.DeepEqual(reply, got) {
+			t.Fatalf("expected listener %v to reply %v but got %v", addr, got, reply)
+		}
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	if err := <-errc; err != ErrServerClosed {
+		t.Fatalf("expected want error %v but got %v", ErrServerClosed, err)
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Fatalf("expected socket file to be removed but got %v", err)
+	}
+}
+
+func TestServerUnknownProfile(t *testing.T) {
+	s := &Server{
+		Listeners: []Listener{{Address: "127.0.0.1:0", Profile: "missing"}},
+		Config:    &Config{},
+	}
+	if err := s.Run(); err != ErrUnknownProfile {
+		t.Fatalf("expected want error %v but got %v", ErrUnknownProfile, err)
+	}
+}
+
+func TestServerListenerFiles(t *testing.T) {
+	s := &Server{
+		Listeners: []Listener{{Address: "127.0.0.1:0"}},
+		Config:    &Config{Logger: DiscardLogger},
+	}
+	if err := s.Serve(); err != ErrServerNotListening {
+		t.Fatalf("expected want error %v but got %v", ErrServerNotListening, err)
+	}
+	if err := s.Listen(); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	files, err := s.ListenerFiles()
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	s.Close()
+
+	// Another server takes over the socket
+	next := &Server{
+		Listeners: []Listener{{File: files[0]}},
+		Config:    &Config{Logger: DiscardLogger},
+	}
+	errc := waitListening(t, next, 1)
+	defer func() {
+		next.Close()
+		<-errc
+	}()
+	if next.Addrs()[0].String() != s.Addrs()[0].String() {
+		t.Fatalf("expected to listen on %v but got %v", s.Addrs()[0], next.Addrs()[0])
+	}
+	conn, err := net.Dial("tcp", next.Addrs()[0].String())
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{SOCKS5Version, 1, MethodNoAuth})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+}
+
+func TestServerKeepSocketFiles(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		sock := filepath.Join(t.TempDir(), "socks.sock")
+		s := &Server{
+			Listeners: []Listener{{Network: "unix", Address: sock}},
+			Config:    &Config{Logger: DiscardLogger},
+		}
+		if err := s.Listen(); err != nil {
+			t.Fatalf("expected want nil but got error: %+v", err)
+		}
+		files, err := s.ListenerFiles()
+		if err != nil {
+			t.Fatalf("expected want nil but got error: %+v", err)
+		}
+		closeFiles(files)
+
+		// A failed handoff doesn't keep the socket file
+		if keep {
+			s.KeepSocketFiles()
+		}
+		s.Close()
+		if _, err := os.Stat(sock); (err == nil) != keep {
+			t.Fatalf("expected socket file kept %v but got error: %v", keep, err)
+		}
+	}
+}
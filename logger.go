@@ -0,0 +1,119 @@
+package socks
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Logger is a leveled, structured logger. Args are alternating keys
+// and values, as for *slog.Logger, which implements this interface.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// LogLevel is the severity of a log record, using the values of slog.Level.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = -4
+	LevelInfo  LogLevel = 0
+	LevelWarn  LogLevel = 4
+	LevelError LogLevel = 8
+)
+
+func (l LogLevel) String() string {
+	switch {
+	case l < LevelInfo:
+		return "DEBUG"
+	case l < LevelWarn:
+		return "INFO"
+	case l < LevelError:
+		return "WARN"
+	default:
+		return "ERROR"
+	}
+}
+
+// NewLogger returns a Logger writing key=value lines to w through
+// the standard log package. Records below level are dropped.
+func NewLogger(w io.Writer, level LogLevel) Logger {
+	return &stdLogger{
+		l:     log.New(w, "", log.LstdFlags),
+		level: level,
+	}
+}
+
+// DiscardLogger drops every record.
+var DiscardLogger Logger = &stdLogger{l: log.New(io.Discard, "", 0), level: LevelError + 1}
+
+// defaultLogger writes warnings and errors to the standard logger, so
+// like before loggers existed only failures are printed by default.
+var defaultLogger Logger = &stdLogger{l: log.Default(), level: LevelWarn}
+
+type stdLogger struct {
+	l     *log.Logger
+	level LogLevel
+}
+
+func (l *stdLogger) Debug(msg string, args ...any) { l.log(LevelDebug, msg, args) }
+func (l *stdLogger) Info(msg string, args ...any)  { l.log(LevelInfo, msg, args) }
+func (l *stdLogger) Warn(msg string, args ...any)  { l.log(LevelWarn, msg, args) }
+func (l *stdLogger) Error(msg string, args ...any) { l.log(LevelError, msg, args) }
+
+func (l *stdLogger) log(level LogLevel, msg string, args []any) {
+	if level < l.level {
+		return
+	}
+	var b strings.Builder
+	b.WriteString("level=")
+	b.WriteString(level.String())
+	b.WriteString(" msg=")
+	b.WriteString(logValue(msg))
+	for i := 0; i < len(args); i += 2 {
+		b.WriteByte(' ')
+		if i+1 == len(args) {
+			// A dangling value, as slog does
+			b.WriteString("!BADKEY=")
+			b.WriteString(logValue(args[i]))
+			break
+		}
+		fmt.Fprint(&b, args[i])
+		b.WriteByte('=')
+		b.WriteString(logValue(args[i+1]))
+	}
+	l.l.Print(b.String())
+}
+
+func logValue(v any) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case time.Duration:
+		return v.String()
+	case error:
+		s = v.Error()
+	case nil:
+		return "<nil>"
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func (c *Config) logger() Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return defaultLogger
+}
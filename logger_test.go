@@ -0,0 +1,139 @@
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStdLogger(t *testing.T) {
+	cases := []struct {
+		name   string
+		level  LogLevel
+		log    func(l Logger)
+		expect string
+	}{
+		{
+			name:  "fields",
+			level: LevelInfo,
+			log: func(l Logger) {
+				l.Info("session closed", "session", 1, "user", "admin", "duration", 1500*time.Millisecond)
+			},
+			expect: `level=INFO msg="session closed" session=1 user=admin duration=1.5s`,
+		},
+		{
+			name:  "quoted_error",
+			level: LevelInfo,
+			log: func(l Logger) {
+				l.Warn("session failed", "error", errors.New("handshake timeout"))
+			},
+			expect: `level=WARN msg="session failed" error="handshake timeout"`,
+		},
+		{
+			name:  "below_level",
+			level: LevelInfo,
+			log: func(l Logger) {
+				l.Debug("session accepted", "session", 1)
+			},
+			expect: "",
+		},
+		{
+			name:  "dangling_value",
+			level: LevelDebug,
+			log: func(l Logger) {
+				l.Debug("accept", "session")
+			},
+			expect: `level=DEBUG msg=accept !BADKEY=session`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			c.log(&stdLogger{l: log.New(&buf, "", 0), level: c.level})
+
+			got := strings.TrimSuffix(buf.String(), "\n")
+			if got != c.expect {
+				t.Fatalf("expected log %q but got %q", c.expect, got)
+			}
+		})
+	}
+}
+
+type logRecord struct {
+	level string
+	msg   string
+	args  map[string]any
+}
+
+// recordLogger keeps the records it receives.
+type recordLogger struct {
+	mu      sync.Mutex
+	records []logRecord
+}
+
+func (l *recordLogger) record(level, msg string, args []any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r := logRecord{level: level, msg: msg, args: make(map[string]any)}
+	for i := 0; i+1 < len(args); i += 2 {
+		r.args[fmt.Sprint(args[i])] = args[i+1]
+	}
+	l.records = append(l.records, r)
+}
+
+func (l *recordLogger) Debug(msg string, args ...any) { l.record("DEBUG", msg, args) }
+func (l *recordLogger) Info(msg string, args ...any)  { l.record("INFO", msg, args) }
+func (l *recordLogger) Warn(msg string, args ...any)  { l.record("WARN", msg, args) }
+func (l *recordLogger) Error(msg string, args ...any) { l.record("ERROR", msg, args) }
+
+func TestServeConnLogs(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	logger := new(recordLogger)
+	conf := *testPasswordConf
+	conf.Logger = logger
+	conf.Quotas = QuotaLimits{Default: Quota{Daily: 1}}
+	s := new(Server)
+	s.quota.set(conf.Quotas)
+	s.quota.add("admin", 1)
+
+	done := make(chan struct{})
+	go func() {
+		s.serveConn(server, &conf)
+		close(done)
+	}()
+	client.Write(testHandshake(""))
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			if _, err := client.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	<-done
+
+	last := logger.records[len(logger.records)-1]
+	if last.level != "WARN" || last.msg != "session failed" {
+		t.Fatalf("expected %v %q record but got %v %q", "WARN", "session failed", last.level, last.msg)
+	}
+	expect := map[string]any{
+		"user":   "admin",
+		"target": "example.com:443",
+		"reply":  ReplyConnectionNotAllowedByRuleset,
+		"error":  ErrQuotaExceeded,
+	}
+	for k, v := range expect {
+		if last.args[k] != v {
+			t.Fatalf("expected field %v=%v but got %v", k, v, last.args[k])
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package socks
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dialBuckets are the upper bounds of the dial latency histogram, in seconds.
+var dialBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// Metrics collects server metrics and serves them in the Prometheus
+// text exposition format. A nil *Metrics collects nothing.
+// The server doesn't relay UDP, so UDP ASSOCIATE requests only
+// show up as rejected associations.
+type Metrics struct {
+	mu         sync.Mutex
+	accepted   uint64
+	active     int64
+	handshakes map[[2]string]uint64
+	replies    map[[2]string]uint64
+	denials    map[string]uint64
+	bytes      map[[2]string]uint64
+
+	udpRejected uint64
+
+	dialCounts []uint64
+	dialCount  uint64
+	dialSum    float64
+
+	// resolver, if caching, has its statistics exported too
+	resolver *CacheResolver
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		handshakes: make(map[[2]string]uint64),
+		replies:    make(map[[2]string]uint64),
+		denials:    make(map[string]uint64),
+		bytes:      make(map[[2]string]uint64),
+		dialCounts: make([]uint64, len(dialBuckets)),
+	}
+}
+
+func (m *Metrics) sessionStarted() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.accepted++
+	m.active++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) sessionEnded(sess *session) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active--
+	if sess.request != nil && sess.replied {
+		m.replies[[2]string{commandName(sess.request.Command), replyName(sess.reply)}]++
+		if sess.request.Command == CmdUDPAssociate && sess.reply != ReplySucceeded {
+			m.udpRejected++
+		}
+	}
+}
+
+func (m *Metrics) handshake(method Method, success bool) {
+	if m == nil {
+		return
+	}
+	result := "failure"
+	if success {
+		result = "success"
+	}
+	m.mu.Lock()
+	m.handshakes[[2]string{methodName(method), result}]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) denial(reason error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.denials[denialName(reason)]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) dial(d time.Duration) {
+	if m == nil {
+		return
+	}
+	seconds := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, bound := range dialBuckets {
+		if seconds <= bound {
+			m.dialCounts[i]++
+		}
+	}
+	m.dialCount++
+	m.dialSum += seconds
+}
+
+func (m *Metrics) transfer(user string, upload bool, n int64) {
+	if m == nil {
+		return
+	}
+	direction := "download"
+	if upload {
+		direction = "upload"
+	}
+	m.mu.Lock()
+	m.bytes[[2]string{direction, user}] += uint64(n)
+	m.mu.Unlock()
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	cw := &countWriter{w: bw}
+
+	m.mu.Lock()
+	writeHeader(cw, "socks_sessions_accepted_total", "counter", "Sessions accepted.")
+	fmt.Fprintf(cw, "socks_sessions_accepted_total %d\n", m.accepted)
+	writeHeader(cw, "socks_sessions_active", "gauge", "Sessions currently open.")
+	fmt.Fprintf(cw, "socks_sessions_active %d\n", m.active)
+
+	writeHeader(cw, "socks_handshakes_total", "counter", "Authentication handshakes by method and result.")
+	for _, k := range sortedKeys(m.handshakes) {
+		fmt.Fprintf(cw, "socks_handshakes_total{method=%s,result=%s} %d\n", labelValue(k[0]), labelValue(k[1]), m.handshakes[k])
+	}
+	writeHeader(cw, "socks_replies_total", "counter", "Replies sent to requests by command and reply.")
+	for _, k := range sortedKeys(m.replies) {
+		fmt.Fprintf(cw, "socks_replies_total{command=%s,reply=%s} %d\n", labelValue(k[0]), labelValue(k[1]), m.replies[k])
+	}
+	writeHeader(cw, "socks_udp_associations_rejected_total", "counter", "UDP ASSOCIATE requests rejected, UDP is not relayed.")
+	fmt.Fprintf(cw, "socks_udp_associations_rejected_total %d\n", m.udpRejected)
+	writeHeader(cw, "socks_denials_total", "counter", "Requests denied by session limits, quotas, drain mode and hooks.")
+	reasons := make([]string, 0, len(m.denials))
+	for reason := range m.denials {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(cw, "socks_denials_total{reason=%s} %d\n", labelValue(reason), m.denials[reason])
+	}
+	writeHeader(cw, "socks_transfer_bytes_total", "counter", "Bytes relayed by direction and user.")
+	for _, k := range sortedKeys(m.bytes) {
+		fmt.Fprintf(cw, "socks_transfer_bytes_total{direction=%s,user=%s} %d\n", labelValue(k[0]), labelValue(k[1]), m.bytes[k])
+	}
+
+	writeHeader(cw, "socks_dial_duration_seconds", "histogram", "Latency of connecting to targets.")
+	for i, bound := range dialBuckets {
+		fmt.Fprintf(cw, "socks_dial_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(bound, 'g', -1, 64), m.dialCounts[i])
+	}
+	fmt.Fprintf(cw, "socks_dial_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.dialCount)
+	fmt.Fprintf(cw, "socks_dial_duration_seconds_sum %s\n", strconv.FormatFloat(m.dialSum, 'g', -1, 64))
+	fmt.Fprintf(cw, "socks_dial_duration_seconds_count %d\n", m.dialCount)
+	resolver := m.resolver
+	m.mu.Unlock()
+
+	if resolver != nil {
+		stats := resolver.Stats()
+		writeHeader(cw, "socks_dns_cache_lookups_total", "counter", "DNS cache lookups by result.")
+		fmt.Fprintf(cw, "socks_dns_cache_lookups_total{result=\"hit\"} %d\n", stats.Hits)
+		fmt.Fprintf(cw, "socks_dns_cache_lookups_total{result=\"negative_hit\"} %d\n", stats.NegativeHits)
+		fmt.Fprintf(cw, "socks_dns_cache_lookups_total{result=\"shared\"} %d\n", stats.Shared)
+		fmt.Fprintf(cw, "socks_dns_cache_lookups_total{result=\"miss\"} %d\n", stats.Misses)
+		writeHeader(cw, "socks_dns_cache_entries", "gauge", "Hosts in the DNS cache.")
+		fmt.Fprintf(cw, "socks_dns_cache_entries %d\n", stats.Entries)
+	}
+
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, bw.Flush()
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func labelValue(v string) string {
+	v = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+	return `"` + v + `"`
+}
+
+func sortedKeys(m map[[2]string]uint64) [][2]string {
+	keys := make([][2]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
+
+type countWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	w.err = err
+	return n, err
+}
+
+func denialName(reason error) string {
+	switch reason {
+	case ErrSessionLimit:
+		return "session_limit"
+	case ErrClientSessionLimit:
+		return "client_session_limit"
+	case ErrUserSessionLimit:
+		return "user_session_limit"
+	case ErrQuotaExceeded:
+		return "quota"
+	case ErrServerDraining:
+		return "draining"
+	}
+	if _, ok := reason.(*hookError); ok {
+		return "hook"
+	}
+	return "other"
+}
+
+func methodName(method Method) string {
+	switch method {
+	case MethodNoAuth:
+		return "no_auth"
+	case MethodGSSAPI:
+		return "gssapi"
+	case MethodPassword:
+		return "password"
+	}
+	return fmt.Sprintf("0x%02x", method)
+}
+
+func commandName(cmd Command) string {
+	switch cmd {
+	case CmdConnect:
+		return "connect"
+	case CmdBind:
+		return "bind"
+	case CmdUDPAssociate:
+		return "udp_associate"
+	case CmdResolve:
+		return "resolve"
+	case CmdResolvePTR:
+		return "resolve_ptr"
+	}
+	return fmt.Sprintf("0x%02x", cmd)
+}
+
+func replyName(reply Reply) string {
+	switch reply {
+	case ReplySucceeded:
+		return "succeeded"
+	case ReplyGeneralSOCKSServerFailure:
+		return "general_failure"
+	case ReplyConnectionNotAllowedByRuleset:
+		return "not_allowed"
+	case ReplyNetworkUnreachable:
+		return "network_unreachable"
+	case ReplyHostUnreachablle:
+		return "host_unreachable"
+	case ReplyConnectionRefused:
+		return "connection_refused"
+	case ReplyTTLExpired:
+		return "ttl_expired"
+	case ReplyCommandNotSupported:
+		return "command_not_supported"
+	case ReplyAddressTypeNotSupported:
+		return "address_type_not_supported"
+	}
+	return fmt.Sprintf("0x%02x", reply)
+}
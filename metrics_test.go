@@ -0,0 +1,82 @@
+package socks
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	m.resolver = &CacheResolver{}
+	m.sessionStarted()
+	m.sessionStarted()
+	m.handshake(MethodPassword, true)
+	m.handshake(MethodPassword, false)
+	m.denial(ErrQuotaExceeded)
+	m.dial(30 * time.Millisecond)
+	m.transfer(`a"b`, true, 100)
+	m.transfer(`a"b`, true, 50)
+	m.sessionEnded(&session{
+		request: &ClientRequestMsg{Command: CmdConnect},
+		reply:   ReplySucceeded,
+		replied: true,
+	})
+	m.sessionEnded(&session{
+		request: &ClientRequestMsg{Command: CmdUDPAssociate},
+		reply:   ReplyCommandNotSupported,
+		replied: true,
+	})
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	got := buf.String()
+
+	expect := []string{
+		"# TYPE socks_sessions_accepted_total counter\n",
+		"socks_sessions_accepted_total 2\n",
+		"socks_sessions_active 0\n",
+		`socks_handshakes_total{method="password",result="failure"} 1` + "\n",
+		`socks_handshakes_total{method="password",result="success"} 1` + "\n",
+		`socks_replies_total{command="connect",reply="succeeded"} 1` + "\n",
+		"socks_udp_associations_rejected_total 1\n",
+		`socks_denials_total{reason="quota"} 1` + "\n",
+		`socks_transfer_bytes_total{direction="upload",user="a\"b"} 150` + "\n",
+		`socks_dial_duration_seconds_bucket{le="0.025"} 0` + "\n",
+		`socks_dial_duration_seconds_bucket{le="0.05"} 1` + "\n",
+		`socks_dial_duration_seconds_bucket{le="+Inf"} 1` + "\n",
+		"socks_dial_duration_seconds_count 1\n",
+		`socks_dns_cache_lookups_total{result="hit"} 0` + "\n",
+		`socks_dns_cache_lookups_total{result="shared"} 0` + "\n",
+	}
+	for _, line := range expect {
+		if !strings.Contains(got, line) {
+			t.Fatalf("expected metrics to contain %q but got:\n%s", line, got)
+		}
+	}
+}
+
+func TestMetricsNil(t *testing.T) {
+	var m *Metrics
+	m.sessionStarted()
+	m.handshake(MethodNoAuth, true)
+	m.dial(time.Second)
+	m.transfer("", false, 1)
+	m.sessionEnded(&session{})
+}
+
+func TestMetricsHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	NewMetrics().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("expected exposition content type but got %v", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "socks_sessions_active 0\n") {
+		t.Fatalf("expected active sessions but got:\n%s", rec.Body.String())
+	}
+}
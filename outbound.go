@@ -0,0 +1,109 @@
+package socks
+
+import (
+	"net"
+)
+
+// Outbound controls which local address and network interface
+// connections to targets leave from.
+type Outbound struct {
+	// LocalIPs are the source addresses, at most one per address family.
+	// If set, targets of a family without a source address are not dialed.
+	LocalIPs []net.IP
+
+	// Interface binds outgoing sockets to a network device with
+	// SO_BINDTODEVICE. Linux only, usually requires CAP_NET_RAW.
+	Interface string
+
+	// ProxyHeader is the version, 1 or 2, of a PROXY protocol header
+	// sent first on target connections, carrying the client address.
+	// Version 2 headers also carry the username in a ProxyTLVUser TLV.
+	// Zero sends no header.
+	ProxyHeader int
+}
+
+func (o *Outbound) validate() error {
+	if o == nil {
+		return nil
+	}
+	var v4, v6 int
+	for _, ip := range o.LocalIPs {
+		switch {
+		case ip.To4() != nil:
+			v4++
+		case len(ip) == net.IPv6len:
+			v6++
+		default:
+			return ErrInvalidOutbound
+		}
+	}
+	if v4 > 1 || v6 > 1 {
+		return ErrInvalidOutbound
+	}
+	if o.ProxyHeader < 0 || o.ProxyHeader > 2 {
+		return ErrProxyHeaderVersion
+	}
+	if o.Interface != "" {
+		if _, err := net.InterfaceByName(o.Interface); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// localIP returns the source address for connections to target,
+// and false if target's address family can't be reached.
+func (o *Outbound) localIP(target net.IP) (net.IP, bool) {
+	if o == nil || len(o.LocalIPs) == 0 {
+		return nil, true
+	}
+	isV4 := target.To4() != nil
+	for _, ip := range o.LocalIPs {
+		if (ip.To4() != nil) == isV4 {
+			return ip, true
+		}
+	}
+	return nil, false
+}
+
+// filter drops the addresses which can't be reached from the source addresses.
+func (o *Outbound) filter(addrs []net.IPAddr) []net.IPAddr {
+	if o == nil || len(o.LocalIPs) == 0 {
+		return addrs
+	}
+	var reachable []net.IPAddr
+	for _, addr := range addrs {
+		if _, ok := o.localIP(addr.IP); ok {
+			reachable = append(reachable, addr)
+		}
+	}
+	return reachable
+}
+
+func (o *Outbound) dialer(target net.IP) *net.Dialer {
+	var d net.Dialer
+	if o == nil {
+		return &d
+	}
+	if ip, _ := o.localIP(target); ip != nil {
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	if o.Interface != "" {
+		d.Control = bindToDevice(o.Interface)
+	}
+	return &d
+}
+
+func (o *Outbound) proxyHeader() int {
+	if o == nil {
+		return 0
+	}
+	return o.ProxyHeader
+}
+
+func (c *Config) outbound(user string) *Outbound {
+	if o, ok := c.UserOutbound[user]; ok {
+		return o
+	}
+	return c.Outbound
+}
@@ -0,0 +1,102 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestOutboundValidate(t *testing.T) {
+	cases := []struct {
+		name     string
+		outbound *Outbound
+		wantErr  bool
+	}{
+		{
+			name:     "nil_success",
+			outbound: nil,
+			wantErr:  false,
+		},
+		{
+			name: "dual_stack_success",
+			outbound: &Outbound{
+				LocalIPs: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+			},
+			wantErr: false,
+		},
+		{
+			name: "two_ipv4",
+			outbound: &Outbound{
+				LocalIPs: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid_ip",
+			outbound: &Outbound{
+				LocalIPs: []net.IP{{1, 2, 3}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "proxy_header_version",
+			outbound: &Outbound{
+				ProxyHeader: 3,
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown_interface",
+			outbound: &Outbound{
+				Interface: "no-such-interface0",
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.outbound.validate()
+			if c.wantErr && err == nil {
+				t.Fatalf("expected want error but got nil")
+			}
+			if !c.wantErr && err != nil {
+				t.Fatalf("expected want nil but got error: %+v", err)
+			}
+		})
+	}
+}
+
+func TestOutboundFilter(t *testing.T) {
+	v4 := net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	v6 := net.IPAddr{IP: net.ParseIP("2001:db8::1")}
+	o := &Outbound{LocalIPs: []net.IP{net.IPv4(127, 0, 0, 1)}}
+
+	got := o.filter([]net.IPAddr{v6, v4})
+	if !reflect.DeepEqual(got, []net.IPAddr{v4}) {
+		t.Fatalf("expected addrs %v but got %v", []net.IPAddr{v4}, got)
+	}
+}
+
+func TestOutboundDialLocalIP(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	port := uint16(lis.Addr().(*net.TCPAddr).Port)
+
+	local := net.IPv4(127, 0, 0, 2)
+	o := &Outbound{LocalIPs: []net.IP{local}}
+	conn, err := dialAddrs(context.Background(), o, []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, port, 0)
+	if err != nil {
+		t.Skipf("cannot bind %v: %v", local, err)
+	}
+	defer conn.Close()
+
+	got := conn.LocalAddr().(*net.TCPAddr).IP
+	if !got.Equal(local) {
+		t.Fatalf("expected local address %v but got %v", local, got)
+	}
+}
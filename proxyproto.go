@@ -0,0 +1,221 @@
+package socks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ProxyProtocol accepts a PROXY protocol v1 or v2 header, as sent by
+// HAProxy and most L4 load balancers, before the SOCKS greeting. The
+// client address it carries replaces the address of the connection
+// in limits, hooks, logs and the admin API.
+type ProxyProtocol struct {
+	// Trusted are the networks of the load balancers. The header is
+	// optional for them. Connections from other addresses are served
+	// with their own address and fail the handshake if they send one.
+	Trusted []*net.IPNet
+}
+
+func (p *ProxyProtocol) trusts(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range p.Trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// ProxyTLVUser is the type of the TLV carrying the username in the
+// PROXY protocol v2 headers sent to targets, the first of the range
+// reserved for applications.
+const ProxyTLVUser = 0xe0
+
+const (
+	proxyV1Prefix = "PROXY "
+	// proxyV1MaxLen is the longest v1 header, CRLF included
+	proxyV1MaxLen = 107
+	proxyV2Sig    = "\r\n\r\n\x00\r\nQUIT\n"
+)
+
+// readProxyHeader reads the PROXY protocol header starting r, if any,
+// and returns the client address it carries. It returns nil if there
+// is no header or the header carries no address, as for health checks.
+func readProxyHeader(r *bufio.Reader, buf []byte) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		return readProxyV1(r)
+	case proxyV2Sig[0]:
+		return readProxyV2(r, buf)
+	}
+	return nil, nil
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || len(line) > proxyV1MaxLen {
+		return nil, ErrInvalidProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(line, []byte(proxyV1Prefix)) || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	fields := strings.Split(string(line[len(proxyV1Prefix):len(line)-2]), " ")
+	switch fields[0] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, ErrInvalidProxyHeader
+	}
+	if len(fields) != 5 {
+		return nil, ErrInvalidProxyHeader
+	}
+	ip := net.ParseIP(fields[1])
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[0] == "TCP4") {
+		return nil, ErrInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r *bufio.Reader, buf []byte) (net.Addr, error) {
+	if _, err := io.ReadFull(r, buf[:16]); err != nil {
+		return nil, err
+	}
+	if string(buf[:12]) != proxyV2Sig || buf[12]>>4 != 2 {
+		return nil, ErrInvalidProxyHeader
+	}
+	command, family := buf[12]&0x0f, buf[13]
+	length := int(binary.BigEndian.Uint16(buf[14:16]))
+
+	var ipLen int
+	switch family >> 4 {
+	case 1:
+		ipLen = IPv4Len
+	case 2:
+		ipLen = IPv6Len
+	}
+	// addresses are followed by the source and destination ports
+	n := 2*ipLen + 4
+	if command > 1 || ipLen > 0 && length < n {
+		return nil, ErrInvalidProxyHeader
+	}
+	var addr net.Addr
+	if ipLen > 0 {
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return nil, err
+		}
+		length -= n
+		// LOCAL connections come from the balancer itself
+		if command == 1 {
+			ip := make(net.IP, ipLen)
+			copy(ip, buf[:ipLen])
+			port := binary.BigEndian.Uint16(buf[2*ipLen:])
+			if family&0x0f == 2 {
+				addr = &net.UDPAddr{IP: ip, Port: int(port)}
+			} else {
+				addr = &net.TCPAddr{IP: ip, Port: int(port)}
+			}
+		}
+	}
+	// skip the TLVs and unsupported address families
+	if _, err := r.Discard(length); err != nil {
+		return nil, err
+	}
+	return addr, nil
+}
+
+// appendProxyHeader appends a PROXY protocol header of version telling
+// a target that the connection from src to dst is proxied for user.
+// A header without addresses is appended if they aren't TCP addresses.
+func appendProxyHeader(b []byte, version int, src, dst net.Addr, user string) []byte {
+	srcIP, dstIP := addrIP(src), addrIP(dst)
+	srcPort, dstPort := addrPort(src), addrPort(dst)
+	ipLen := IPv6Len
+	if srcIP != nil && dstIP != nil && srcIP.To4() != nil && dstIP.To4() != nil {
+		ipLen = IPv4Len
+		srcIP, dstIP = srcIP.To4(), dstIP.To4()
+	}
+	known := srcIP != nil && dstIP != nil
+
+	if version == 1 {
+		// v1 can't mix address families
+		if !known || ipLen == IPv6Len && (srcIP.To4() != nil || dstIP.To4() != nil) {
+			return append(b, "PROXY UNKNOWN\r\n"...)
+		}
+		family := "TCP4"
+		if ipLen == IPv6Len {
+			family = "TCP6"
+		}
+		return append(b, fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, srcPort, dstPort)...)
+	}
+
+	b = append(b, proxyV2Sig...)
+	b = append(b, 0x21)
+	length := 0
+	switch {
+	case !known:
+		b = append(b, 0x00)
+	case ipLen == IPv4Len:
+		b, length = append(b, 0x11), 2*IPv4Len+4
+	default:
+		b, length = append(b, 0x21), 2*IPv6Len+4
+		srcIP, dstIP = srcIP.To16(), dstIP.To16()
+	}
+	if user != "" {
+		length += 3 + len(user)
+	}
+	b = append(b, byte(length>>8), byte(length))
+	if known {
+		b = append(append(b, srcIP...), dstIP...)
+		b = append(b, byte(srcPort>>8), byte(srcPort), byte(dstPort>>8), byte(dstPort))
+	}
+	if user != "" {
+		b = append(b, ProxyTLVUser, byte(len(user)>>8), byte(len(user)))
+		b = append(b, user...)
+	}
+	return b
+}
+
+func addrPort(addr net.Addr) int {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.Port
+	case *net.UDPAddr:
+		return addr.Port
+	}
+	return 0
+}
@@ -0,0 +1,199 @@
+package socks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+)
+
+func proxyV2Header(command, family byte, addr []byte, tlvs []byte) []byte {
+	b := append([]byte(proxyV2Sig), 0x20|command, family)
+	n := len(addr) + len(tlvs)
+	b = append(b, byte(n>>8), byte(n))
+	return append(append(b, addr...), tlvs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x0f, 0xa0, 0x04, 0x38}
+	v6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x0f, 0xa0, 0x04, 0x38)
+	cases := []struct {
+		name   string
+		header []byte
+		expect string
+		err    error
+	}{
+		{"none", nil, "", nil},
+		{"v1_tcp4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 4000 1080\r\n"), "192.0.2.1:4000", nil},
+		{"v1_tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 4000 1080\r\n"), "[2001:db8::1]:4000", nil},
+		{"v1_unknown", []byte("PROXY UNKNOWN\r\n"), "", nil},
+		{"v1_family_mismatch", []byte("PROXY TCP4 2001:db8::1 2001:db8::2 4000 1080\r\n"), "", ErrInvalidProxyHeader},
+		{"v1_bad_port", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 70000 1080\r\n"), "", ErrInvalidProxyHeader},
+		{"v1_no_crlf", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 4000 1080\n"), "", ErrInvalidProxyHeader},
+		{"v1_too_long", []byte("PROXY TCP4 " + string(bytes.Repeat([]byte{' '}, 100)) + "\r\n"), "", ErrInvalidProxyHeader},
+		{"v2_tcp4", proxyV2Header(1, 0x11, v4, nil), "192.0.2.1:4000", nil},
+		{"v2_tcp6_tlv", proxyV2Header(1, 0x21, v6, []byte{0x04, 0x00, 0x01, 0xff}), "[2001:db8::1]:4000", nil},
+		{"v2_local", proxyV2Header(0, 0x11, v4, nil), "", nil},
+		{"v2_unspec", proxyV2Header(1, 0x00, nil, []byte{1, 2, 3}), "", nil},
+		{"v2_short", proxyV2Header(1, 0x11, v4[:8], nil), "", ErrInvalidProxyHeader},
+		{"v2_bad_command", proxyV2Header(2, 0x11, v4, nil), "", ErrInvalidProxyHeader},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := bufio.NewReaderSize(bytes.NewReader(append(c.header, SOCKS5Version)), codecReadBufferSize)
+			addr, err := readProxyHeader(r, make([]byte, 255))
+			if err != c.err {
+				t.Fatalf("expected want error %v but got %v", c.err, err)
+			}
+			if err != nil {
+				return
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != c.expect {
+				t.Fatalf("expected client %q but got %q", c.expect, got)
+			}
+			if b, err := r.ReadByte(); err != nil || b != SOCKS5Version {
+				t.Fatalf("expected the greeting after the header but got %v %v", b, err)
+			}
+		})
+	}
+}
+
+func TestServerProxyProtocol(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, other, _ := net.ParseCIDR("10.0.0.0/8")
+	cases := []struct {
+		name    string
+		trusted *net.IPNet
+		header  string
+		expect  string
+	}{
+		{"trusted", loopback, "PROXY TCP4 192.0.2.1 198.51.100.1 4000 1080\r\n", "192.0.2.1:4000"},
+		{"trusted_without_header", loopback, "", "127.0.0.1"},
+		{"untrusted", other, "PROXY TCP4 192.0.2.1 198.51.100.1 4000 1080\r\n", "127.0.0.1"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("expected want nil but got error: %+v", err)
+			}
+			defer lis.Close()
+			client, err := net.Dial("tcp", lis.Addr().String())
+			if err != nil {
+				t.Fatalf("expected want nil but got error: %+v", err)
+			}
+			defer client.Close()
+			server, err := lis.Accept()
+			if err != nil {
+				t.Fatalf("expected want nil but got error: %+v", err)
+			}
+
+			clients := make(chan net.Addr, 1)
+			conf := &Config{
+				Logger:        DiscardLogger,
+				ProxyProtocol: &ProxyProtocol{Trusted: []*net.IPNet{c.trusted}},
+				Hooks: Hooks{OnAccept: func(ctx context.Context, info SessionInfo) error {
+					clients <- info.Client
+					return nil
+				}},
+			}
+			go new(Server).serveConn(server, conf)
+			client.Write(append([]byte(c.header), SOCKS5Version, 1, MethodNoAuth))
+
+			got := (<-clients).String()
+			if host, _, err := net.SplitHostPort(got); c.expect == "127.0.0.1" && err == nil {
+				got = host
+			}
+			if got != c.expect {
+				t.Fatalf("expected client %v but got %v", c.expect, got)
+			}
+		})
+	}
+}
+
+func TestAppendProxyHeader(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4000}
+	client6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 4000}
+	target := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+	target6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	cases := []struct {
+		name    string
+		version int
+		src     net.Addr
+		dst     net.Addr
+		expect  string
+	}{
+		{"v1_tcp4", 1, client, target, "192.0.2.1:4000"},
+		{"v1_tcp6", 1, client6, target6, "[2001:db8::1]:4000"},
+		{"v1_mixed", 1, client, target6, ""},
+		{"v1_unknown", 1, &net.UnixAddr{Name: "@", Net: "unix"}, target, ""},
+		{"v2_tcp4", 2, client, target, "192.0.2.1:4000"},
+		// as an IPv4-mapped IPv6 address
+		{"v2_mixed", 2, client, target6, "192.0.2.1:4000"},
+		{"v2_unknown", 2, &net.UnixAddr{Name: "@", Net: "unix"}, target, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			header := appendProxyHeader(nil, c.version, c.src, c.dst, "admin")
+			r := bufio.NewReader(bytes.NewReader(header))
+			addr, err := readProxyHeader(r, make([]byte, 255))
+			if err != nil {
+				t.Fatalf("expected want nil but got error: %+v", err)
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != c.expect {
+				t.Fatalf("expected client %q but got %q", c.expect, got)
+			}
+			if r.Buffered() != 0 {
+				t.Fatalf("expected the whole header to be read but %v bytes are left", r.Buffered())
+			}
+			if tlv := []byte{ProxyTLVUser, 0, 5, 'a', 'd', 'm', 'i', 'n'}; c.version == 2 && !bytes.HasSuffix(header, tlv) {
+				t.Fatalf("expected header to end with the user TLV %v but got %v", tlv, header)
+			}
+		})
+	}
+}
+
+func TestOutboundProxyHeader(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	defer lis.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		header := appendProxyHeader(nil, 2, &net.UnixAddr{}, nil, "admin")
+		buf := make([]byte, len(header)+4)
+		io.ReadFull(conn, buf)
+		received <- buf
+	}()
+	targetAddr := lis.Addr().(*net.TCPAddr)
+
+	conf := *testPasswordConf
+	conf.Outbound = &Outbound{ProxyHeader: 2}
+	conf.Hooks.OnRequest = func(ctx context.Context, info SessionInfo, req *ClientRequestMsg) error {
+		req.Address, req.Port = targetAddr.IP.String(), uint16(targetAddr.Port)
+		return nil
+	}
+	runHookSession(t, &conf)
+
+	// net.Pipe has no client address
+	expect := append(appendProxyHeader(nil, 2, &net.UnixAddr{}, nil, "admin"), "ping"...)
+	if got := <-received; !bytes.Equal(got, expect) {
+		t.Fatalf("expected target to receive %q but got %q", expect, got)
+	}
+}
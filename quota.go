@@ -0,0 +1,307 @@
+package socks
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const defaultQuotaFlushInterval = 10 * time.Second
+
+// Quota limits the traffic of a user in both directions, in bytes.
+// Zero means unlimited. Days and months are in local time.
+type Quota struct {
+	Daily   int64
+	Monthly int64
+}
+
+// QuotaLimits configures per-user traffic quotas. Users which exceed
+// their quota are denied new requests.
+type QuotaLimits struct {
+	// Default applies to every authenticated user, Users overrides it.
+	Default Quota
+	Users   map[string]Quota
+
+	// CutLive also closes the live tunnels of users over their quota.
+	CutLive bool
+
+	// Store persists the counters so restarts don't reset them.
+	// They are saved every FlushInterval, default 10s, and when the
+	// server closes. Reload merges the counters of a new store and
+	// applies a new interval right away.
+	Store         QuotaStore
+	FlushInterval time.Duration
+}
+
+func (l *QuotaLimits) user(user string) Quota {
+	if q, ok := l.Users[user]; ok {
+		return q
+	}
+	return l.Default
+}
+
+// Usage is the traffic of a user in bytes.
+type Usage struct {
+	Day        string `json:"day"`
+	DayBytes   int64  `json:"day_bytes"`
+	Month      string `json:"month"`
+	MonthBytes int64  `json:"month_bytes"`
+	TotalBytes int64  `json:"total_bytes"`
+}
+
+func (u *Usage) roll(now time.Time) {
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day, u.DayBytes = day, 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.MonthBytes = month, 0
+	}
+}
+
+func (u *Usage) exceeds(q Quota) bool {
+	return (q.Daily > 0 && u.DayBytes >= q.Daily) ||
+		(q.Monthly > 0 && u.MonthBytes >= q.Monthly)
+}
+
+// QuotaStore persists the usage counters of users.
+type QuotaStore interface {
+	Load() (map[string]Usage, error)
+	Save(usage map[string]Usage) error
+}
+
+// FileQuotaStore stores usage counters in a JSON file.
+type FileQuotaStore struct {
+	Path string
+}
+
+func (f FileQuotaStore) Load() (map[string]Usage, error) {
+	data, err := os.ReadFile(f.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var usage map[string]Usage
+	if err := json.Unmarshal(data, &usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// Save replaces the file atomically, so a crash never leaves it truncated.
+func (f FileQuotaStore) Save(usage map[string]Usage) error {
+	data, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.Path), filepath.Base(f.Path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+// quotaTracker counts the traffic of users. The zero value doesn't enforce quotas.
+type quotaTracker struct {
+	mu     sync.Mutex
+	limits QuotaLimits
+	usage  map[string]*Usage
+	dirty  bool
+	// saving orders concurrent flushes so an older snapshot
+	// never overwrites a newer one
+	saving sync.Mutex
+	// changed wakes the flush loop to apply new limits
+	changed chan struct{}
+
+	now func() time.Time
+}
+
+func (q *quotaTracker) set(limits QuotaLimits) {
+	q.mu.Lock()
+	q.limits = limits
+	changed := q.changedLocked()
+	q.mu.Unlock()
+	select {
+	case changed <- struct{}{}:
+	default:
+	}
+}
+
+func (q *quotaTracker) changedLocked() chan struct{} {
+	if q.changed == nil {
+		q.changed = make(chan struct{}, 1)
+	}
+	return q.changed
+}
+
+// load reads the counters persisted in store, keeping counters already
+// in memory, which are then saved to store at the next flush.
+func (q *quotaTracker) load(store QuotaStore) error {
+	if store == nil {
+		return nil
+	}
+	usage, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.usage == nil {
+		q.usage = make(map[string]*Usage)
+	}
+	if len(q.usage) > 0 {
+		q.dirty = true
+	}
+	for user, u := range usage {
+		if _, ok := q.usage[user]; !ok {
+			u := u
+			q.usage[user] = &u
+		}
+	}
+	return nil
+}
+
+// flush saves the counters if they changed since the last flush.
+func (q *quotaTracker) flush() error {
+	q.saving.Lock()
+	defer q.saving.Unlock()
+	q.mu.Lock()
+	store := q.limits.Store
+	if store == nil || !q.dirty {
+		q.mu.Unlock()
+		return nil
+	}
+	usage := make(map[string]Usage, len(q.usage))
+	for user, u := range q.usage {
+		usage[user] = *u
+	}
+	q.dirty = false
+	q.mu.Unlock()
+
+	if err := store.Save(usage); err != nil {
+		q.mu.Lock()
+		q.dirty = true
+		q.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// flushLoop saves the counters periodically until done is closed,
+// then a last time.
+func (q *quotaTracker) flushLoop(logger Logger, done <-chan struct{}) {
+	q.mu.Lock()
+	changed := q.changedLocked()
+	q.mu.Unlock()
+	for {
+		timer := time.NewTimer(q.flushInterval())
+		select {
+		case <-timer.C:
+			q.save(logger)
+		case <-changed:
+			timer.Stop()
+		case <-done:
+			timer.Stop()
+			q.save(logger)
+			return
+		}
+	}
+}
+
+func (q *quotaTracker) flushInterval() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.limits.FlushInterval <= 0 {
+		return defaultQuotaFlushInterval
+	}
+	return q.limits.FlushInterval
+}
+
+func (q *quotaTracker) save(logger Logger) {
+	if err := q.flush(); err != nil {
+		logger.Error("save quota usage failure", "error", err)
+	}
+}
+
+// exceeded reports whether user is over its quota.
+func (q *quotaTracker) exceeded(user string) bool {
+	if user == "" {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u, ok := q.usage[user]
+	if !ok {
+		return false
+	}
+	u.roll(q.clock())
+	return u.exceeds(q.limits.user(user))
+}
+
+// add counts n bytes of traffic of user. It returns ErrQuotaExceeded
+// if the user is over its quota and live tunnels have to be cut.
+func (q *quotaTracker) add(user string, n int64) error {
+	if user == "" {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.usage == nil {
+		q.usage = make(map[string]*Usage)
+	}
+	u, ok := q.usage[user]
+	if !ok {
+		u = new(Usage)
+		q.usage[user] = u
+	}
+	u.roll(q.clock())
+	u.DayBytes += n
+	u.MonthBytes += n
+	u.TotalBytes += n
+	q.dirty = true
+	if q.limits.CutLive && u.exceeds(q.limits.user(user)) {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+func (q *quotaTracker) get(user string) Usage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u, ok := q.usage[user]
+	if !ok {
+		return Usage{}
+	}
+	u.roll(q.clock())
+	return *u
+}
+
+func (q *quotaTracker) clock() time.Time {
+	if q.now != nil {
+		return q.now()
+	}
+	return time.Now()
+}
+
+// Usage returns the traffic counters of user.
+func (s *Server) Usage(user string) Usage {
+	return s.quota.get(user)
+}
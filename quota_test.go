@@ -0,0 +1,227 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQuotaTracker(t *testing.T) {
+	cases := []struct {
+		name         string
+		limits       QuotaLimits
+		user         string
+		add          []int64
+		elapsed      time.Duration
+		wantExceeded bool
+		wantErr      bool
+	}{
+		{
+			name:         "below_daily",
+			limits:       QuotaLimits{Default: Quota{Daily: 100}},
+			user:         "admin",
+			add:          []int64{50, 49},
+			wantExceeded: false,
+		},
+		{
+			name:         "daily_exceeded",
+			limits:       QuotaLimits{Default: Quota{Daily: 100}},
+			user:         "admin",
+			add:          []int64{50, 50},
+			wantExceeded: true,
+		},
+		{
+			name:         "daily_reset",
+			limits:       QuotaLimits{Default: Quota{Daily: 100}},
+			user:         "admin",
+			add:          []int64{50, 50},
+			elapsed:      24 * time.Hour,
+			wantExceeded: false,
+		},
+		{
+			name:         "monthly_exceeded_next_day",
+			limits:       QuotaLimits{Default: Quota{Daily: 100, Monthly: 150}},
+			user:         "admin",
+			add:          []int64{99, 99},
+			elapsed:      24 * time.Hour,
+			wantExceeded: true,
+		},
+		{
+			name: "user_override",
+			limits: QuotaLimits{
+				Default: Quota{Daily: 100},
+				Users:   map[string]Quota{"admin": {}},
+			},
+			user:         "admin",
+			add:          []int64{50, 50},
+			wantExceeded: false,
+		},
+		{
+			name:         "cut_live",
+			limits:       QuotaLimits{Default: Quota{Daily: 100}, CutLive: true},
+			user:         "admin",
+			add:          []int64{50, 50},
+			wantExceeded: true,
+			wantErr:      true,
+		},
+		{
+			name:         "anonymous",
+			limits:       QuotaLimits{Default: Quota{Daily: 100}, CutLive: true},
+			user:         "",
+			add:          []int64{50, 50},
+			wantExceeded: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// Noon on the 15th so a day later is in the same month
+			now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.Local)
+			q := quotaTracker{now: func() time.Time { return now }}
+			q.set(c.limits)
+
+			var err error
+			for _, n := range c.add {
+				err = q.add(c.user, n)
+				now = now.Add(c.elapsed)
+			}
+			if c.wantErr && err != ErrQuotaExceeded {
+				t.Fatalf("expected want error %v but got %v", ErrQuotaExceeded, err)
+			}
+			if !c.wantErr && err != nil {
+				t.Fatalf("expected want nil but got error: %+v", err)
+			}
+			if got := q.exceeded(c.user); got != c.wantExceeded {
+				t.Fatalf("expected exceeded %v but got %v", c.wantExceeded, got)
+			}
+		})
+	}
+}
+
+func TestQuotaPersistence(t *testing.T) {
+	store := FileQuotaStore{Path: filepath.Join(t.TempDir(), "usage.json")}
+
+	var q quotaTracker
+	q.set(QuotaLimits{Store: store})
+	if err := q.load(store); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	q.add("admin", 1024)
+	if err := q.flush(); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+
+	// A restarted server continues counting
+	var restarted quotaTracker
+	restarted.set(QuotaLimits{Store: store})
+	if err := restarted.load(store); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	restarted.add("admin", 1024)
+
+	got := restarted.get("admin")
+	expect := q.get("admin")
+	expect.DayBytes, expect.MonthBytes, expect.TotalBytes = 2048, 2048, 2048
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expected usage %+v but got %+v", expect, got)
+	}
+}
+
+func TestServerQuotaSavedOnClose(t *testing.T) {
+	dir := t.TempDir()
+	store := FileQuotaStore{Path: filepath.Join(dir, "usage.json")}
+	echo := echoServer(t)
+	newServer := func(store QuotaStore) *Server {
+		conf := *testPasswordConf
+		conf.Logger = DiscardLogger
+		conf.Quotas = QuotaLimits{Store: store, FlushInterval: time.Hour}
+		return &Server{Listeners: []Listener{{Address: "127.0.0.1:0"}}, Config: &conf}
+	}
+	ping := func(conn net.Conn) {
+		conn.Write([]byte("ping"))
+		if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+			t.Fatalf("expected want nil but got error: %+v", err)
+		}
+	}
+
+	s := newServer(store)
+	errc := waitListening(t, s, 1)
+	dialer := &Dialer{Server: s.Addrs()[0].String(), Username: "admin", Password: "123456"}
+	closed, err := dialer.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	ping(closed)
+	closed.Close()
+	draining, err := dialer.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	for s.Usage("admin").TotalBytes != 8 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The counters are saved on Close, and again when sessions
+	// draining after Close end
+	s.Close()
+	<-errc
+	ping(draining)
+	draining.Close()
+	for len(s.Sessions()) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	restarted := newServer(store)
+	if err := restarted.Listen(); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	defer restarted.Close()
+	if got := restarted.Usage("admin").TotalBytes; got != 16 {
+		t.Fatalf("expected %v bytes used but got %v", 16, got)
+	}
+
+	// Reloading with another store loads its counters
+	other := FileQuotaStore{Path: filepath.Join(dir, "other.json")}
+	if err := other.Save(map[string]Usage{"hulu": {TotalBytes: 100}}); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	if err := restarted.Reload(newServer(other).Config); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	if got := restarted.Usage("hulu").TotalBytes; got != 100 {
+		t.Fatalf("expected %v bytes used but got %v", 100, got)
+	}
+	if err := restarted.Reload(newServer(FileQuotaStore{Path: dir}).Config); err == nil {
+		t.Fatalf("expected an error reloading an unreadable store but got nil")
+	}
+}
+
+func TestQuotaFlushIntervalReload(t *testing.T) {
+	store := FileQuotaStore{Path: filepath.Join(t.TempDir(), "usage.json")}
+	var q quotaTracker
+	q.set(QuotaLimits{Store: store, FlushInterval: time.Hour})
+	done := make(chan struct{})
+	defer close(done)
+	go q.flushLoop(DiscardLogger, done)
+
+	// A shorter interval applies without waiting for the hour
+	q.add("admin", 1024)
+	q.set(QuotaLimits{Store: store, FlushInterval: 10 * time.Millisecond})
+	deadline := time.Now().Add(time.Second)
+	for {
+		usage, err := store.Load()
+		if err != nil {
+			t.Fatalf("expected want nil but got error: %+v", err)
+		}
+		if usage["admin"].TotalBytes == 1024 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected usage saved at the new interval but got %+v", usage)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,210 @@
+package socks
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+)
+
+const (
+	relayBufferSize = 32 << 10
+	spliceChunkSize = 1 << 20
+)
+
+var (
+	errNoHalfClose = errors.New("connection does not support half-close")
+
+	relayBufferPool = sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, relayBufferSize)
+			return &buf
+		},
+	}
+)
+
+// RelayStats reports the traffic and the errors of both directions
+// of a tunnel. Upload is client to target, download target to client.
+type RelayStats struct {
+	Upload      int64
+	Download    int64
+	UploadErr   error
+	DownloadErr error
+}
+
+// tunnel holds the per-session state of forward.
+type tunnel struct {
+	timeouts  *tunnelTimeouts
+	bandwidth *tunnelBandwidth
+	account   func(n int64, upload bool) error
+	// done is closed when the session ends, nil if it never does
+	done <-chan struct{}
+	// aborted is closed by forward when the tunnel is torn down
+	aborted chan struct{}
+}
+
+// forward relays between server and target until both directions are
+// done. EOF in one direction is propagated with CloseWrite, so the other
+// direction keeps working (TCP half-close). An error in one direction
+// closes both connections and is returned.
+func forward(server, target net.Conn, t *tunnel) (RelayStats, error) {
+	defer target.Close()
+	t.aborted = make(chan struct{})
+
+	var (
+		stats    RelayStats
+		mu       sync.Mutex
+		aborted  bool
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	// abort closes both connections, errors caused by that are ignored
+	abort := func(cause error) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if aborted {
+			return false
+		}
+		aborted, firstErr = true, cause
+		close(t.aborted)
+		server.Close()
+		target.Close()
+		return true
+	}
+	pipe := func(dst, src net.Conn, upload bool, n *int64, errp *error) {
+		defer wg.Done()
+		written, err := t.pipe(dst, src, upload)
+		*n = written
+		if err != nil {
+			if abort(err) {
+				*errp = err
+			}
+			return
+		}
+		// Propagate EOF, or end the tunnel if dst can't be half-closed
+		if err := closeWrite(dst); err != nil {
+			abort(nil)
+		}
+	}
+
+	wg.Add(2)
+	go pipe(target, server, true, &stats.Upload, &stats.UploadErr)
+	pipe(server, target, false, &stats.Download, &stats.DownloadErr)
+	wg.Wait()
+	return stats, firstErr
+}
+
+// pipe copies src to dst until EOF. Between TCP connections the data is
+// moved with ReadFrom, which uses splice(2) on Linux, other connections
+// are copied through pooled buffers. The copy is made in chunks to
+// enforce timeouts, throttling and quotas along the way.
+func (t *tunnel) pipe(dst, src net.Conn, upload bool) (int64, error) {
+	buckets := t.bandwidth.down
+	if upload {
+		buckets = t.bandwidth.up
+	}
+	rf, splice := dst.(io.ReaderFrom)
+	splice = splice && canSplice(dst, src)
+	var buf []byte
+	if !splice {
+		bufp := relayBufferPool.Get().(*[]byte)
+		defer relayBufferPool.Put(bufp)
+		buf = *bufp
+	}
+
+	var written int64
+	for {
+		size := int64(len(buf))
+		if splice {
+			size = spliceChunkSize
+		}
+		for _, b := range buckets {
+			if chunk := int64(b.chunk()); chunk > 0 && chunk < size {
+				size = chunk
+			}
+		}
+
+		// Writes only time out at the end of the session lifetime,
+		// a blocked write is ended by the other direction timing out
+		src.SetReadDeadline(t.timeouts.deadline())
+		dst.SetWriteDeadline(t.timeouts.expires)
+
+		var (
+			n   int64
+			eof bool
+			err error
+		)
+		if splice {
+			n, err = rf.ReadFrom(&io.LimitedReader{R: src, N: size})
+			eof = err == nil && n < size
+		} else {
+			n, eof, err = copyBuffer(dst, src, buf[:size])
+		}
+		written += n
+
+		if n > 0 {
+			t.timeouts.touch()
+			if t.account != nil {
+				if err := t.account(n, upload); err != nil {
+					return written, err
+				}
+			}
+			if err := t.throttle(buckets, n); err != nil {
+				return written, err
+			}
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if err := t.timeouts.expired(); err != nil {
+				return written, err
+			}
+			// The tunnel was active meanwhile
+			continue
+		}
+		if err != nil || eof {
+			return written, err
+		}
+	}
+}
+
+// copyBuffer makes a single read from src and writes it to dst.
+func copyBuffer(dst io.Writer, src io.Reader, buf []byte) (int64, bool, error) {
+	nr, rerr := src.Read(buf)
+	if nr > 0 {
+		nw, werr := dst.Write(buf[:nr])
+		if werr != nil {
+			return int64(nw), false, werr
+		}
+		if nw != nr {
+			return int64(nw), false, io.ErrShortWrite
+		}
+	}
+	if rerr == io.EOF {
+		return int64(nr), true, nil
+	}
+	return int64(nr), false, rerr
+}
+
+// canSplice reports whether ReadFrom of dst moves data from src
+// without copying it to user space.
+func canSplice(dst, src net.Conn) bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
+	if _, ok := dst.(*net.TCPConn); !ok {
+		return false
+	}
+	switch src.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errNoHalfClose
+}
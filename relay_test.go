@@ -0,0 +1,168 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func tcpPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := lis.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := <-accepted
+	if conn == nil {
+		t.Fatal("accept failure")
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		conn.Close()
+	})
+	return dialed.(*net.TCPConn), conn.(*net.TCPConn)
+}
+
+func newTestTunnel(account func(n int64, upload bool) error) *tunnel {
+	return &tunnel{
+		timeouts:  newTunnelTimeouts(&Config{}, time.Now()),
+		bandwidth: new(bandwidthLimiter).open(""),
+		account:   account,
+	}
+}
+
+type relayResult struct {
+	stats RelayStats
+	err   error
+}
+
+func TestForwardHalfClose(t *testing.T) {
+	client, server := tcpPair(t)
+	target, remote := tcpPair(t)
+
+	done := make(chan relayResult, 1)
+	go func() {
+		stats, err := forward(server, target, newTestTunnel(nil))
+		done <- relayResult{stats, err}
+	}()
+
+	// The remote answers after the client finished sending
+	client.Write([]byte("hello"))
+	client.CloseWrite()
+	got, err := io.ReadAll(remote)
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("expected remote to read %q but got %q, error: %+v", "hello", got, err)
+	}
+	remote.Write([]byte("world!"))
+	remote.Close()
+
+	got, err = io.ReadAll(client)
+	if err != nil || string(got) != "world!" {
+		t.Fatalf("expected client to read %q but got %q, error: %+v", "world!", got, err)
+	}
+
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("expected want nil but got error: %+v", res.err)
+	}
+	if res.stats.Upload != 5 || res.stats.Download != 6 {
+		t.Fatalf("expected 5 bytes up and 6 down but got %+v", res.stats)
+	}
+}
+
+func TestForwardAbort(t *testing.T) {
+	client, server := tcpPair(t)
+	target, remote := tcpPair(t)
+	defer remote.Close()
+
+	// Spliced transfers are accounted per chunk, use buffers
+	// so the first write is accounted right away
+	done := make(chan relayResult, 1)
+	go func() {
+		stats, err := forward(hideConn{server}, hideConn{target}, newTestTunnel(func(n int64, upload bool) error {
+			return ErrQuotaExceeded
+		}))
+		done <- relayResult{stats, err}
+	}()
+
+	client.Write([]byte("hello"))
+	res := <-done
+	if res.err != ErrQuotaExceeded {
+		t.Fatalf("expected want error %v but got %v", ErrQuotaExceeded, res.err)
+	}
+	if res.stats.UploadErr != ErrQuotaExceeded || res.stats.DownloadErr != nil {
+		t.Fatalf("expected only upload error %v but got %+v", ErrQuotaExceeded, res.stats)
+	}
+
+	// Both directions are closed
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadAll(client); err != nil {
+		t.Fatalf("expected client to read EOF but got error: %+v", err)
+	}
+}
+
+// hideConn hides the concrete type of a connection, disabling splice.
+type hideConn struct {
+	net.Conn
+}
+
+func (c hideConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func BenchmarkForward(b *testing.B) {
+	cases := []struct {
+		name string
+		wrap func(net.Conn) net.Conn
+	}{
+		{
+			name: "splice",
+			wrap: func(conn net.Conn) net.Conn { return conn },
+		},
+		{
+			name: "buffered",
+			wrap: func(conn net.Conn) net.Conn { return hideConn{conn} },
+		},
+	}
+
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			client, server := tcpPair(b)
+			target, remote := tcpPair(b)
+
+			done := make(chan struct{})
+			go func() {
+				forward(c.wrap(server), c.wrap(target), newTestTunnel(nil))
+				close(done)
+			}()
+			go func() {
+				io.Copy(io.Discard, remote)
+				remote.Close()
+			}()
+
+			buf := make([]byte, 128<<10)
+			b.SetBytes(int64(len(buf)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := client.Write(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+			client.CloseWrite()
+			<-done
+		})
+	}
+}
@@ -18,6 +18,12 @@ const (
 	CmdConnect      Command = 0x01
 	CmdBind         Command = 0x02
 	CmdUDPAssociate Command = 0x03
+
+	// CmdResolve and CmdResolvePTR are the Tor extension commands
+	// looking up the address of a domain name and the name of an
+	// address, answered in the BND.ADDR field of the reply.
+	CmdResolve    Command = 0xF0
+	CmdResolvePTR Command = 0xF1
 )
 
 type AddressType = byte
@@ -28,9 +34,11 @@ const (
 	IPv6Addr   AddressType = 0x04
 )
 
+// Lengths of the address and port fields of requests and replies.
+// IPv6Len was 6 in earlier versions, which truncated IPv6 addresses.
 const (
 	IPv4Len = 4
-	IPv6Len = 6
+	IPv6Len = 16
 	PortLen = 2
 )
 
@@ -56,98 +64,114 @@ const (
 //
 // The SOCKS request is formed as follows:
 //
-//      +----+-----+-------+------+----------+----------+
-//      |VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
-//      +----+-----+-------+------+----------+----------+
-//      | 1  |  1  | X'00' |  1   | Variable |    2     |
-//      +----+-----+-------+------+----------+----------+
+//	+----+-----+-------+------+----------+----------+
+//	|VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
+//	+----+-----+-------+------+----------+----------+
+//	| 1  |  1  | X'00' |  1   | Variable |    2     |
+//	+----+-----+-------+------+----------+----------+
 func NewClientRequestMsg(conn io.Reader) (*ClientRequestMsg, error) {
-	// Read version, command, reserved, address type
-	buf := make([]byte, 4)
-	if _, err := io.ReadFull(conn, buf); err != nil {
+	var msg ClientRequestMsg
+	if err := readClientRequestMsg(conn, make([]byte, 255), &msg); err != nil {
 		return nil, err
 	}
+	return &msg, nil
+}
+
+// readClientRequestMsg parses the message into msg, buf must hold 255 bytes.
+func readClientRequestMsg(conn io.Reader, buf []byte, msg *ClientRequestMsg) error {
+	// Read version, command, reserved, address type
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return err
+	}
 
 	version, command, reserved, addrType := buf[0], buf[1], buf[2], buf[3]
 
 	// Check if the fields are valid
 	if version != SOCKS5Version {
-		return nil, ErrVersionNotSupported
+		return ErrVersionNotSupported
 	}
-	if command != CmdBind && command != CmdConnect && command != CmdUDPAssociate {
-		return nil, ErrCommandNotSupported
+	switch command {
+	case CmdConnect, CmdBind, CmdUDPAssociate, CmdResolve, CmdResolvePTR:
+	default:
+		return ErrCommandNotSupported
 	}
 	if reserved != ReservedField {
-		return nil, ErrInvalidReservedField
+		return ErrInvalidReservedField
 	}
 	if addrType != IPv4Addr && addrType != DomainName && addrType != IPv6Addr {
-		return nil, ErrAddrTypeNotSupported
+		return ErrAddrTypeNotSupported
 	}
 
-	msg := ClientRequestMsg{
-		Command:  command,
-		AddrType: addrType,
-	}
+	msg.Command = command
+	msg.AddrType = addrType
 
 	// Read address
 	switch addrType {
-	case IPv6Addr:
-		buf = make([]byte, IPv6Len)
-		fallthrough
-	case IPv4Addr:
-		if _, err := io.ReadFull(conn, buf); err != nil {
-			return nil, err
+	case IPv4Addr, IPv6Addr:
+		addrLen := IPv4Len
+		if addrType == IPv6Addr {
+			addrLen = IPv6Len
+		}
+		if _, err := io.ReadFull(conn, buf[:addrLen]); err != nil {
+			return err
 		}
-		msg.Address = net.IP(buf).String()
+		msg.Address = net.IP(buf[:addrLen]).String()
 	case DomainName:
 		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
-			return nil, err
+			return err
 		}
 		domainLen := buf[0]
-		if domainLen > IPv4Len {
-			buf = make([]byte, domainLen)
-		}
 		if _, err := io.ReadFull(conn, buf[:domainLen]); err != nil {
-			return nil, err
+			return err
 		}
 		msg.Address = string(buf[:domainLen])
 	}
 
 	// Read port
 	if _, err := io.ReadFull(conn, buf[:PortLen]); err != nil {
-		return nil, err
+		return err
 	}
 	msg.Port = (uint16(buf[0]) << 8) + uint16(buf[1])
 
-	return &msg, nil
+	return nil
 }
 
 func WriteReqSuccessMsg(conn io.Writer, ip net.IP, port uint16) error {
+	_, err := conn.Write(appendReqSuccessMsg(make([]byte, 0, 6+IPv6Len), ip, port))
+	return err
+}
+
+// appendReqSuccessMsg appends the reply so it can be sent in one write.
+func appendReqSuccessMsg(b []byte, ip net.IP, port uint16) []byte {
 	addrType := IPv4Addr
-	if len(ip) == IPv6Len {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
 		addrType = IPv6Addr
 	}
-	// Write version, reply success, reserved, address type
-	_, err := conn.Write([]byte{SOCKS5Version, ReplySucceeded, ReservedField, addrType})
-	if err != nil {
-		return err
-	}
+	// version, reply success, reserved, address type
+	b = append(b, SOCKS5Version, ReplySucceeded, ReservedField, addrType)
+	// bind IP(IPv4/IPv6)
+	b = append(b, ip...)
+	// bind port
+	return append(b, byte(port>>8), byte(port))
+}
 
-	// Write bind IP(IPv4/IPv6)
-	_, err = conn.Write(ip)
-	if err != nil {
-		return err
+// appendReqDomainMsg appends a successful reply binding a domain name.
+func appendReqDomainMsg(b []byte, host string, port uint16) ([]byte, error) {
+	if len(host) > 255 {
+		return b, ErrDomainNameTooLong
 	}
-
-	// Write bind port
-	buf := make([]byte, 2)
-	buf[0] = byte(port >> 8)
-	buf[1] = byte(port - uint16(buf[0])<<8)
-	_, err = conn.Write(buf)
-	return err
+	b = append(b, SOCKS5Version, ReplySucceeded, ReservedField, DomainName, byte(len(host)))
+	b = append(b, host...)
+	return append(b, byte(port>>8), byte(port)), nil
 }
 
 func WriteReqFailureMsg(conn io.Writer, reply Reply) error {
-	_, err := conn.Write([]byte{SOCKS5Version, reply, ReservedField, IPv4Addr, 0, 0, 0, 0, 0, 0})
+	_, err := conn.Write(appendReqFailureMsg(nil, reply))
 	return err
 }
+
+func appendReqFailureMsg(b []byte, reply Reply) []byte {
+	return append(b, SOCKS5Version, reply, ReservedField, IPv4Addr, 0, 0, 0, 0, 0, 0)
+}
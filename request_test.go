@@ -36,6 +36,37 @@ func TestNewClientRequestMsg(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name:     "ipv6_success",
+			version:  SOCKS5Version,
+			rsv:      ReservedField,
+			cmd:      CmdConnect,
+			addrType: IPv6Addr,
+			addr:     net.ParseIP("2001:db8::1"),
+			port:     []byte{0x01, 0xbb},
+			expectMsg: ClientRequestMsg{
+				Command:  CmdConnect,
+				AddrType: IPv6Addr,
+				Address:  "2001:db8::1",
+				Port:     443,
+			},
+			wantErr: false,
+		},
+		{
+			name:     "resolve_ptr_success",
+			version:  SOCKS5Version,
+			rsv:      ReservedField,
+			cmd:      CmdResolvePTR,
+			addrType: IPv4Addr,
+			addr:     []byte{192, 168, 168, 201},
+			port:     []byte{0x00, 0x00},
+			expectMsg: ClientRequestMsg{
+				Command:  CmdResolvePTR,
+				AddrType: IPv4Addr,
+				Address:  "192.168.168.201",
+			},
+			wantErr: false,
+		},
 		{
 			name:     "invalid_version",
 			version:  0x00,
@@ -152,6 +183,21 @@ func TestWriteReqSuccessMsg(t *testing.T) {
 			expectMsg: []byte{SOCKS5Version, ReplySucceeded, ReservedField, IPv4Addr, 123, 123, 11, 11, 0x04, 0x39},
 			wantErr:   false,
 		},
+		{
+			name:      "ipv4_in_ipv6_success",
+			ip:        net.IPv4(123, 123, 11, 11),
+			port:      1081,
+			expectMsg: []byte{SOCKS5Version, ReplySucceeded, ReservedField, IPv4Addr, 123, 123, 11, 11, 0x04, 0x39},
+			wantErr:   false,
+		},
+		{
+			name: "ipv6_success",
+			ip:   net.ParseIP("2001:db8::1"),
+			port: 1081,
+			expectMsg: []byte{SOCKS5Version, ReplySucceeded, ReservedField, IPv6Addr,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x04, 0x39},
+			wantErr: false,
+		},
 	}
 
 	for _, c := range cases {
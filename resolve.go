@@ -0,0 +1,60 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+var errNoNames = errors.New("no names resolved")
+
+// resolve answers a RESOLVE request with the address of the domain
+// name, or a RESOLVE_PTR request with the name of the address.
+func resolve(ctx context.Context, c *codec, conf *Config, msg *ClientRequestMsg) error {
+	if msg.Command == CmdResolve {
+		addrs, err := resolveTarget(ctx, conf, msg)
+		if err != nil {
+			c.writeReqFailureMsg(ReplyHostUnreachablle)
+			return err
+		}
+		return c.writeReqSuccessMsg(addrs[0].IP, 0)
+	}
+
+	if msg.AddrType == DomainName {
+		c.writeReqFailureMsg(ReplyAddressTypeNotSupported)
+		return ErrAddrTypeNotSupported
+	}
+	names, err := lookupAddr(ctx, conf, msg.Address)
+	if errors.Is(err, ErrReverseLookupNotSupported) {
+		c.writeReqFailureMsg(ReplyCommandNotSupported)
+		return err
+	}
+	if err != nil {
+		c.writeReqFailureMsg(ReplyHostUnreachablle)
+		return err
+	}
+	return c.writeReqDomainMsg(names[0], 0)
+}
+
+// lookupAddr returns the names of addr without their trailing dot,
+// leaving out names too long for a reply.
+func lookupAddr(ctx context.Context, conf *Config, addr string) ([]string, error) {
+	r, ok := conf.resolver().(PTRResolver)
+	if !ok {
+		return nil, ErrReverseLookupNotSupported
+	}
+	names, err := r.LookupAddr(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	valid := names[:0]
+	for _, name := range names {
+		if name = strings.TrimSuffix(name, "."); name != "" && len(name) <= 255 {
+			valid = append(valid, name)
+		}
+	}
+	if len(valid) == 0 {
+		return nil, errNoNames
+	}
+	return valid, nil
+}
@@ -0,0 +1,123 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+type ptrResolver struct {
+	stubResolver
+	names map[string][]string
+}
+
+func (r *ptrResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	names, ok := r.names[addr]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+	return names, nil
+}
+
+// resolveThrough sends a cmd request for host to the server at addr,
+// returning the reply and its bound address.
+func resolveThrough(t *testing.T, addr string, cmd Command, host string) (Reply, string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	defer conn.Close()
+	conn.Write(appendClientRequestMsg([]byte{SOCKS5Version, 1, MethodNoAuth}, cmd, host, 0))
+	buf := make([]byte, 255+PortLen)
+	if _, err := io.ReadFull(conn, buf[:2+4]); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	reply, addrType := buf[3], buf[5]
+	addrLen := IPv4Len
+	switch addrType {
+	case IPv6Addr:
+		addrLen = IPv6Len
+	case DomainName:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			t.Fatalf("expected want nil but got error: %+v", err)
+		}
+		addrLen = int(buf[0])
+	}
+	if _, err := io.ReadFull(conn, buf[:addrLen+PortLen]); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	if addrType == DomainName {
+		return reply, string(buf[:addrLen])
+	}
+	return reply, net.IP(buf[:addrLen]).String()
+}
+
+func TestResolveCommands(t *testing.T) {
+	resolver := &ptrResolver{
+		stubResolver: stubResolver{addrs: map[string][]net.IPAddr{
+			"example.com": {{IP: net.ParseIP("2001:db8::1")}, {IP: net.ParseIP("192.0.2.1")}},
+		}},
+		names: map[string][]string{"192.0.2.1": {"example.com."}},
+	}
+	vetoed := errors.New("vetoed")
+	s := testServer(t, &Config{
+		Resolver:        resolver,
+		ResolveCommands: true,
+		Hooks: Hooks{OnRequest: func(ctx context.Context, info SessionInfo, req *ClientRequestMsg) error {
+			if req.Address == "blocked.example.com" {
+				return vetoed
+			}
+			return nil
+		}},
+	})
+	disabled := testServer(t, &Config{Resolver: resolver})
+	noPTR := testServer(t, &Config{Resolver: &resolver.stubResolver, ResolveCommands: true})
+
+	cases := []struct {
+		name   string
+		server *Server
+		cmd    Command
+		host   string
+		reply  Reply
+		addr   string
+	}{
+		{"resolve", s, CmdResolve, "example.com", ReplySucceeded, "2001:db8::1"},
+		{"resolve_ip", s, CmdResolve, "192.0.2.7", ReplySucceeded, "192.0.2.7"},
+		{"resolve_not_found", s, CmdResolve, "missing.example.com", ReplyHostUnreachablle, "0.0.0.0"},
+		{"resolve_vetoed", s, CmdResolve, "blocked.example.com", ReplyConnectionNotAllowedByRuleset, "0.0.0.0"},
+		{"resolve_ptr", s, CmdResolvePTR, "192.0.2.1", ReplySucceeded, "example.com"},
+		{"resolve_ptr_not_found", s, CmdResolvePTR, "192.0.2.2", ReplyHostUnreachablle, "0.0.0.0"},
+		{"resolve_ptr_domain", s, CmdResolvePTR, "example.com", ReplyAddressTypeNotSupported, "0.0.0.0"},
+		{"resolve_ptr_unsupported", noPTR, CmdResolvePTR, "192.0.2.1", ReplyCommandNotSupported, "0.0.0.0"},
+		{"disabled", disabled, CmdResolve, "example.com", ReplyCommandNotSupported, "0.0.0.0"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reply, addr := resolveThrough(t, c.server.Addrs()[0].String(), c.cmd, c.host)
+			if reply != c.reply || addr != c.addr {
+				t.Fatalf("expected %v %v but got %v %v", replyName(c.reply), c.addr, replyName(reply), addr)
+			}
+		})
+	}
+}
+
+func TestAppendReqDomainMsg(t *testing.T) {
+	got, err := appendReqDomainMsg(nil, "example.com", 443)
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	msg, err := NewClientRequestMsg(bytes.NewReader(append([]byte{SOCKS5Version, CmdConnect}, got[2:]...)))
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	if got[1] != ReplySucceeded || msg.AddrType != DomainName || msg.Address != "example.com" || msg.Port != 443 {
+		t.Fatalf("expected reply binding %v:%v but got %v", "example.com", 443, got)
+	}
+	if _, err := appendReqDomainMsg(nil, strings.Repeat("a", 256), 443); err != ErrDomainNameTooLong {
+		t.Fatalf("expected want error %v but got %v", ErrDomainNameTooLong, err)
+	}
+}
@@ -0,0 +1,297 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Resolver resolves the domain names of request targets.
+// *net.Resolver satisfies this interface.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// PTRResolver is implemented by resolvers which look up the names of
+// addresses, as needed by the RESOLVE_PTR command. *net.Resolver
+// satisfies this interface.
+type PTRResolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// TTLResolver is implemented by resolvers which know the TTL of the
+// records they return. CacheResolver uses it to honour record TTLs.
+type TTLResolver interface {
+	Resolver
+	LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error)
+}
+
+const (
+	defaultCacheTTL        = time.Minute
+	defaultCacheNegTTL     = 10 * time.Second
+	defaultCacheMaxTTL     = time.Hour
+	defaultCacheMaxEntries = 4096
+
+	// cacheLookupTimeout bounds upstream queries, which don't end with
+	// the caller starting them
+	cacheLookupTimeout = 10 * time.Second
+)
+
+// CacheResolver is an in-process DNS cache in front of another Resolver.
+// Concurrent lookups of the same host are collapsed into one query,
+// which goes on if the caller starting it gives up.
+//
+// Record TTLs are only honoured if the upstream resolver implements
+// TTLResolver. The package doesn't ship one, net.Resolver doesn't
+// report TTLs, so by default every answer is cached for DefaultTTL.
+// The zero value is ready to use and caches net.DefaultResolver.
+type CacheResolver struct {
+	// Resolver is the upstream resolver. If nil, net.DefaultResolver is used.
+	Resolver Resolver
+
+	// DefaultTTL is used when the upstream resolver does not report
+	// record TTLs, which is the case for net.Resolver. Default 1m.
+	DefaultTTL time.Duration
+
+	// MinTTL and MaxTTL clamp the TTL of positive answers.
+	// MaxTTL defaults to 1h, MinTTL to no clamp.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+
+	// NegativeTTL is how long NXDOMAIN answers are cached.
+	// Default 10s, a negative value disables negative caching.
+	NegativeTTL time.Duration
+
+	// MaxEntries bounds the number of cached hosts. Default 4096.
+	MaxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	calls   map[string]*lookupCall
+	stats   CacheStats
+
+	now func() time.Time
+}
+
+type cacheEntry struct {
+	addrs   []net.IPAddr
+	err     error
+	expires time.Time
+}
+
+type lookupCall struct {
+	// done is closed once addrs and err are set
+	done  chan struct{}
+	addrs []net.IPAddr
+	err   error
+}
+
+// CacheStats reports the effectiveness of a CacheResolver.
+type CacheStats struct {
+	Hits         uint64
+	NegativeHits uint64
+	Misses       uint64
+	// Shared are the lookups waiting for the query of a concurrent miss
+	Shared  uint64
+	Entries int
+}
+
+// HitRatio returns the share of lookups not querying the upstream resolver.
+func (s CacheStats) HitRatio() float64 {
+	total := s.Hits + s.NegativeHits + s.Shared + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits+s.NegativeHits+s.Shared) / float64(total)
+}
+
+// Stats returns a snapshot of the cache counters.
+func (r *CacheResolver) Stats() CacheStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := r.stats
+	stats.Entries = len(r.entries)
+	return stats
+}
+
+// Flush drops every cached answer.
+func (r *CacheResolver) Flush() {
+	r.mu.Lock()
+	r.entries = nil
+	r.mu.Unlock()
+}
+
+func (r *CacheResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+
+	r.mu.Lock()
+	if e, ok := r.entries[host]; ok {
+		if r.clock().Before(e.expires) {
+			if e.err != nil {
+				r.stats.NegativeHits++
+			} else {
+				r.stats.Hits++
+			}
+			r.mu.Unlock()
+			return copyAddrs(e.addrs), e.err
+		}
+		delete(r.entries, host)
+	}
+
+	// Collapse concurrent lookups of the same host
+	c, ok := r.calls[host]
+	if ok {
+		r.stats.Shared++
+	} else {
+		r.stats.Misses++
+		c = &lookupCall{done: make(chan struct{})}
+		if r.calls == nil {
+			r.calls = make(map[string]*lookupCall)
+		}
+		r.calls[host] = c
+		go r.query(host, c)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return copyAddrs(c.addrs), c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// query looks host up for the callers waiting on c. It doesn't use
+// the context of a caller, whose session may end before the others.
+func (r *CacheResolver) query(host string, c *lookupCall) {
+	ctx, cancel := context.WithTimeout(context.Background(), cacheLookupTimeout)
+	defer cancel()
+	addrs, ttl, err := r.lookup(ctx, host)
+	c.addrs, c.err = addrs, err
+
+	r.mu.Lock()
+	delete(r.calls, host)
+	if ttl > 0 {
+		r.store(host, &cacheEntry{
+			addrs:   addrs,
+			err:     err,
+			expires: r.clock().Add(ttl),
+		})
+	}
+	r.mu.Unlock()
+	close(c.done)
+}
+
+// LookupAddr looks up the names of addr with the upstream resolver,
+// reverse lookups aren't cached.
+func (r *CacheResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	switch upstream := r.Resolver.(type) {
+	case PTRResolver:
+		return upstream.LookupAddr(ctx, addr)
+	case nil:
+		return net.DefaultResolver.LookupAddr(ctx, addr)
+	}
+	return nil, ErrReverseLookupNotSupported
+}
+
+// lookup queries the upstream resolver and returns how long
+// the answer may be cached, 0 meaning not at all.
+func (r *CacheResolver) lookup(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	var (
+		addrs []net.IPAddr
+		ttl   time.Duration
+		err   error
+	)
+	switch upstream := r.Resolver.(type) {
+	case TTLResolver:
+		addrs, ttl, err = upstream.LookupIPAddrTTL(ctx, host)
+	case nil:
+		addrs, err = net.DefaultResolver.LookupIPAddr(ctx, host)
+	default:
+		addrs, err = upstream.LookupIPAddr(ctx, host)
+	}
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, r.negativeTTL(), err
+		}
+		// Don't cache timeouts and server failures
+		return nil, 0, err
+	}
+	return addrs, r.clampTTL(ttl), nil
+}
+
+func (r *CacheResolver) clampTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		ttl = r.DefaultTTL
+		if ttl <= 0 {
+			ttl = defaultCacheTTL
+		}
+	}
+	if ttl < r.MinTTL {
+		ttl = r.MinTTL
+	}
+	maxTTL := r.MaxTTL
+	if maxTTL <= 0 {
+		maxTTL = defaultCacheMaxTTL
+	}
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	return ttl
+}
+
+func (r *CacheResolver) negativeTTL() time.Duration {
+	if r.NegativeTTL == 0 {
+		return defaultCacheNegTTL
+	}
+	if r.NegativeTTL < 0 {
+		return 0
+	}
+	return r.NegativeTTL
+}
+
+// store must be called with r.mu held.
+func (r *CacheResolver) store(host string, e *cacheEntry) {
+	if r.entries == nil {
+		r.entries = make(map[string]*cacheEntry)
+	}
+	maxEntries := r.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheMaxEntries
+	}
+	if len(r.entries) >= maxEntries {
+		now := r.clock()
+		for h, old := range r.entries {
+			if !now.Before(old.expires) {
+				delete(r.entries, h)
+			}
+		}
+		// Still full, evict arbitrary entries
+		for h := range r.entries {
+			if len(r.entries) < maxEntries {
+				break
+			}
+			delete(r.entries, h)
+		}
+	}
+	r.entries[host] = e
+}
+
+func (r *CacheResolver) clock() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+func copyAddrs(addrs []net.IPAddr) []net.IPAddr {
+	if addrs == nil {
+		return nil
+	}
+	return append([]net.IPAddr(nil), addrs...)
+}
@@ -0,0 +1,210 @@
+package socks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type stubResolver struct {
+	calls int32
+	ttl   time.Duration
+	block chan struct{}
+	addrs map[string][]net.IPAddr
+}
+
+func (r *stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, _, err := r.LookupIPAddrTTL(ctx, host)
+	return addrs, err
+}
+
+func (r *stubResolver) LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	atomic.AddInt32(&r.calls, 1)
+	if r.block != nil {
+		<-r.block
+	}
+	addrs, ok := r.addrs[host]
+	if !ok {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, r.ttl, nil
+}
+
+func TestCacheResolver(t *testing.T) {
+	cases := []struct {
+		name      string
+		ttl       time.Duration
+		minTTL    time.Duration
+		maxTTL    time.Duration
+		host      string
+		elapsed   time.Duration
+		wantCalls int32
+		wantErr   bool
+	}{
+		{
+			name:      "hit_within_ttl",
+			ttl:       time.Minute,
+			host:      "example.com",
+			elapsed:   30 * time.Second,
+			wantCalls: 1,
+		},
+		{
+			name:      "miss_after_ttl",
+			ttl:       time.Minute,
+			host:      "example.com",
+			elapsed:   2 * time.Minute,
+			wantCalls: 2,
+		},
+		{
+			name:      "min_ttl_clamp",
+			ttl:       time.Second,
+			minTTL:    time.Minute,
+			host:      "example.com",
+			elapsed:   30 * time.Second,
+			wantCalls: 1,
+		},
+		{
+			name:      "max_ttl_clamp",
+			ttl:       time.Hour,
+			maxTTL:    time.Minute,
+			host:      "example.com",
+			elapsed:   2 * time.Minute,
+			wantCalls: 2,
+		},
+		{
+			name:      "negative_hit",
+			host:      "nxdomain.example.com",
+			elapsed:   5 * time.Second,
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name:      "negative_expired",
+			host:      "nxdomain.example.com",
+			elapsed:   time.Minute,
+			wantCalls: 2,
+			wantErr:   true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			now := time.Now()
+			stub := &stubResolver{
+				ttl: c.ttl,
+				addrs: map[string][]net.IPAddr{
+					"example.com": {{IP: net.IPv4(127, 0, 0, 1)}},
+				},
+			}
+			r := &CacheResolver{
+				Resolver: stub,
+				MinTTL:   c.minTTL,
+				MaxTTL:   c.maxTTL,
+				now:      func() time.Time { return now },
+			}
+
+			for i := 0; i < 2; i++ {
+				_, err := r.LookupIPAddr(context.Background(), c.host)
+				if c.wantErr && err == nil {
+					t.Fatalf("expected want error but got nil")
+				}
+				if !c.wantErr && err != nil {
+					t.Fatalf("expected want nil but got error: %+v", err)
+				}
+				now = now.Add(c.elapsed)
+			}
+
+			if stub.calls != c.wantCalls {
+				t.Fatalf("expected %v upstream lookups but got %v", c.wantCalls, stub.calls)
+			}
+		})
+	}
+}
+
+func TestCacheResolverSingleflight(t *testing.T) {
+	stub := &stubResolver{
+		block: make(chan struct{}),
+		addrs: map[string][]net.IPAddr{
+			"example.com": {{IP: net.IPv4(127, 0, 0, 1)}},
+		},
+	}
+	r := &CacheResolver{Resolver: stub}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addrs, err := r.LookupIPAddr(context.Background(), "example.com")
+			if err != nil || len(addrs) != 1 {
+				t.Errorf("expected one address but got %v, error: %+v", addrs, err)
+			}
+		}()
+	}
+	// Release the query once every caller waits on it
+	for r.Stats().Shared != 9 {
+		time.Sleep(time.Millisecond)
+	}
+	close(stub.block)
+	wg.Wait()
+
+	if stub.calls != 1 {
+		t.Fatalf("expected 1 upstream lookup but got %v", stub.calls)
+	}
+	stats := r.Stats()
+	if stats.Misses != 1 || stats.Shared != 9 {
+		t.Fatalf("expected 1 miss and 9 shared lookups but got %+v", stats)
+	}
+	if _, err := r.LookupIPAddr(context.Background(), "example.com"); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	if ratio := r.Stats().HitRatio(); ratio != 10.0/11 {
+		t.Fatalf("expected hit ratio %v but got %v", 10.0/11, ratio)
+	}
+}
+
+func TestCacheResolverCanceledCaller(t *testing.T) {
+	stub := &stubResolver{
+		block: make(chan struct{}),
+		addrs: map[string][]net.IPAddr{
+			"example.com": {{IP: net.IPv4(127, 0, 0, 1)}},
+		},
+	}
+	r := &CacheResolver{Resolver: stub}
+
+	// The caller starting the query gives up, the other one still
+	// gets the answer
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := r.LookupIPAddr(ctx, "example.com")
+		first <- err
+	}()
+	for atomic.LoadInt32(&stub.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	second := make(chan error, 1)
+	go func() {
+		addrs, err := r.LookupIPAddr(context.Background(), "example.com")
+		if err == nil && len(addrs) != 1 {
+			err = fmt.Errorf("got addresses %v", addrs)
+		}
+		second <- err
+	}()
+
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Fatalf("expected want error %v but got %v", context.Canceled, err)
+	}
+	close(stub.block)
+	if err := <-second; err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	if stub.calls != 1 {
+		t.Fatalf("expected 1 upstream lookup but got %v", stub.calls)
+	}
+}
@@ -0,0 +1,134 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// session is the state of one client connection.
+type session struct {
+	id    uint64
+	conn  net.Conn
+	start time.Time
+	// client is the address of the client, carried by the PROXY
+	// protocol header if any
+	client net.Addr
+	// dst is the original destination of a transparent session
+	dst *net.TCPAddr
+	// ctx is canceled when the session ends
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	user    string
+	request *ClientRequestMsg
+	// remote is the address of the target connection
+	remote net.Addr
+	// reply is the reply sent to the request, if replied
+	reply   Reply
+	replied bool
+
+	handshake time.Duration
+	dial      time.Duration
+	stats     RelayStats
+
+	// upload and download count the bytes relayed so far
+	upload   int64
+	download int64
+	// published is the SessionInfo seen by other goroutines, updated
+	// by publish as the session progresses
+	published atomic.Value
+	// closed is set when the session was closed by Server.CloseSession
+	closed int32
+}
+
+func newSession(id uint64, conn net.Conn) *session {
+	ctx, cancel := context.WithCancel(context.Background())
+	sess := &session{
+		id:     id,
+		conn:   conn,
+		start:  time.Now(),
+		client: conn.RemoteAddr(),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	if tc, ok := conn.(*transparentConn); ok {
+		sess.conn, sess.dst = tc.TCPConn, tc.dst
+	}
+	sess.publish()
+	return sess
+}
+
+// target returns the requested host:port.
+func (sess *session) target() string {
+	if sess.request == nil {
+		return ""
+	}
+	return net.JoinHostPort(sess.request.Address, strconv.Itoa(int(sess.request.Port)))
+}
+
+func (sess *session) info() SessionInfo {
+	return SessionInfo{
+		ID:       sess.id,
+		Client:   sess.client,
+		Start:    sess.start,
+		User:     sess.user,
+		Target:   sess.target(),
+		Remote:   sess.remote,
+		Upload:   atomic.LoadInt64(&sess.upload),
+		Download: atomic.LoadInt64(&sess.download),
+	}
+}
+
+// publish makes the current state of the session visible to snapshot.
+func (sess *session) publish() {
+	sess.published.Store(sess.info())
+}
+
+// snapshot returns the last published state of the session.
+// Unlike info it is safe to call from any goroutine.
+func (sess *session) snapshot() SessionInfo {
+	info := sess.published.Load().(SessionInfo)
+	info.Upload = atomic.LoadInt64(&sess.upload)
+	info.Download = atomic.LoadInt64(&sess.download)
+	return info
+}
+
+// transferred counts relayed bytes.
+func (sess *session) transferred(n int64, upload bool) {
+	if upload {
+		atomic.AddInt64(&sess.upload, n)
+	} else {
+		atomic.AddInt64(&sess.download, n)
+	}
+}
+
+// close aborts the session from another goroutine.
+func (sess *session) close() {
+	atomic.StoreInt32(&sess.closed, 1)
+	sess.cancel()
+	sess.conn.Close()
+}
+
+// logArgs returns the fields describing the session in log records.
+func (sess *session) logArgs() []any {
+	args := []any{
+		"session", sess.id,
+		"client", sess.client.String(),
+	}
+	if sess.user != "" {
+		args = append(args, "user", sess.user)
+	}
+	if sess.request != nil {
+		args = append(args, "command", sess.request.Command, "target", sess.target())
+	}
+	if sess.remote != nil {
+		args = append(args, "remote", sess.remote.String())
+	}
+	if sess.replied {
+		args = append(args, "reply", sess.reply)
+	}
+	return args
+}
@@ -0,0 +1,84 @@
+package socks
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// soOriginalDst is SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST
+	soOriginalDst   = 80
+	ipv6Transparent = 75
+
+	transparentSupported = true
+)
+
+// bindToDevice returns a dialer control function which binds
+// the socket to the network interface iface.
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+// setTransparent is a listener control function setting IP_TRANSPARENT,
+// so the socket accepts connections to foreign addresses of TPROXY rules.
+func setTransparent(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if network == "tcp4" {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		} else {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// originalDst returns the destination of conn before it was rewritten
+// by an iptables REDIRECT rule.
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	var (
+		addr    *net.TCPAddr
+		sockErr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		if local != nil && local.IP.To4() != nil {
+			// the sockaddr_in fits in the 20 bytes of an ipv6_mreq
+			var mreq *syscall.IPv6Mreq
+			if mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); sockErr == nil {
+				sa := mreq.Multiaddr
+				addr = &net.TCPAddr{IP: net.IPv4(sa[4], sa[5], sa[6], sa[7]), Port: int(sa[2])<<8 | int(sa[3])}
+			}
+			return
+		}
+		// the sockaddr_in6 fits in the 32 bytes of an ip6_mtuinfo
+		var info *syscall.IPv6MTUInfo
+		if info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst); sockErr == nil {
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, info.Addr.Addr[:])
+			addr = &net.TCPAddr{IP: ip, Port: int(port[0])<<8 | int(port[1])}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, sockErr
+}
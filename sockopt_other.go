@@ -0,0 +1,24 @@
+//go:build !linux
+
+package socks
+
+import (
+	"net"
+	"syscall"
+)
+
+const transparentSupported = false
+
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return ErrBindToDeviceNotSupported
+	}
+}
+
+func setTransparent(network, address string, c syscall.RawConn) error {
+	return ErrTransparentNotSupported
+}
+
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, ErrTransparentNotSupported
+}
@@ -1,10 +1,13 @@
 package socks
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,138 +21,559 @@ type Socks interface {
 }
 
 type Server struct {
-	IP     string
-	Port   string
+	IP   string
+	Port string
+	// Listeners are the addresses to listen on. If empty, the
+	// server listens on IP:Port.
+	Listeners []Listener
+
+	// Config is the configuration the server starts with.
+	// Use Reload to replace it while running.
 	Config *Config
+
+	// conf holds the *Config of new sessions
+	conf atomic.Value
+
+	limiter   sessionLimiter
+	bandwidth bandwidthLimiter
+	quota     quotaTracker
+
+	// lastID is the ID of the last accepted session
+	lastID uint64
+
+	mu        sync.Mutex
+	sessions  map[uint64]*session
+	listeners []net.Listener
+	// httpServers serve metrics and the admin API
+	httpServers []*http.Server
+	closed      bool
+	// doneCh is closed by Close
+	doneCh   chan struct{}
+	draining int32
 }
 
 type Config struct {
 	AuthMethod      Method
 	PasswordChecker func(username, password string) bool
+
+	// Resolver resolves domain name targets, net.DefaultResolver if nil.
+	// Use a *CacheResolver to avoid resolving the same hosts repeatedly.
+	Resolver Resolver
+
+	// ResolveCommands enables the RESOLVE and RESOLVE_PTR commands,
+	// letting clients look up names and addresses with Resolver.
+	// RESOLVE_PTR needs a Resolver implementing PTRResolver. Hooks
+	// see these requests as any other.
+	ResolveCommands bool
+
+	// FallbackDelay is the RFC 8305 Connection Attempt Delay used when a
+	// target resolves to several addresses: the next address is tried if
+	// the previous one hasn't connected after this long. Default 250ms,
+	// a negative value tries the addresses one after another.
+	FallbackDelay time.Duration
+
+	// Outbound selects the source address and network interface of
+	// target connections. UserOutbound overrides it per username.
+	Outbound     *Outbound
+	UserOutbound map[string]*Outbound
+
+	// HandshakeTimeout bounds the time from accepting a connection until
+	// the tunnel is established. Default 10s, a negative value disables it.
+	HandshakeTimeout time.Duration
+
+	// IdleTimeout closes tunnels without traffic in either direction
+	// for this long. MaxSessionLifetime closes tunnels this long after
+	// the connection was accepted. Zero means no limit.
+	IdleTimeout        time.Duration
+	MaxSessionLifetime time.Duration
+
+	// Limits bounds the number of concurrent sessions. Sessions over
+	// a limit are answered with ReplyGeneralSOCKSServerFailure.
+	Limits Limits
+
+	// Bandwidth throttles tunnel traffic. Use Server.SetBandwidth
+	// to change the limits of a running server.
+	Bandwidth BandwidthLimits
+
+	// Quotas limits the traffic of authenticated users.
+	Quotas QuotaLimits
+
+	// Logger receives the log records of the server. If nil, records of
+	// level warn and above are written to the standard logger.
+	Logger Logger
+
+	// AccessLog receives a record of every session when it ends.
+	AccessLog AccessLog
+
+	// Metrics collects server metrics. If MetricsAddr is set, they are
+	// served at /metrics of an HTTP listener on that address.
+	Metrics     *Metrics
+	MetricsAddr string
+
+	// Hooks are called at the stages of every session.
+	Hooks Hooks
+
+	// Admin enables the admin HTTP API if set.
+	Admin *Admin
+
+	// ProxyProtocol accepts the client address from load balancers
+	// if set.
+	ProxyProtocol *ProxyProtocol
+
+	// Profiles are named overrides of the authentication and outbound
+	// settings, used by the sessions of listeners selecting them.
+	Profiles map[string]*Profile
 }
 
 func (s *Server) initConf() error {
-	if s.Config.AuthMethod == MethodPassword && s.Config.PasswordChecker == nil {
+	if err := prepareConf(s.Config); err != nil {
+		return err
+	}
+	if err := s.checkProfiles(s.Config); err != nil {
+		return err
+	}
+	s.bandwidth.set(s.Config.Bandwidth)
+	s.quota.set(s.Config.Quotas)
+	s.conf.Store(s.Config)
+	return s.quota.load(s.Config.Quotas.Store)
+}
+
+// prepareConf validates conf and fills in the values derived from it.
+func prepareConf(conf *Config) error {
+	if conf.AuthMethod == MethodPassword && conf.PasswordChecker == nil {
 		return ErrPasswordCheckerNotSet
 	}
+	if err := conf.Outbound.validate(); err != nil {
+		return err
+	}
+	for _, o := range conf.UserOutbound {
+		if err := o.validate(); err != nil {
+			return err
+		}
+	}
+	if err := conf.Admin.validate(); err != nil {
+		return err
+	}
+	for _, p := range conf.Profiles {
+		if err := p.validate(); err != nil {
+			return err
+		}
+	}
+	if conf.MetricsAddr != "" && conf.Metrics == nil {
+		conf.Metrics = NewMetrics()
+	}
+	if cache, ok := conf.Resolver.(*CacheResolver); ok && conf.Metrics != nil {
+		conf.Metrics.resolver = cache
+	}
 	return nil
 }
 
+// Reload replaces the configuration of a running server. New sessions
+// use conf, open sessions keep the configuration they started with,
+// except for bandwidth limits which apply to open tunnels too. The
+// listener, metrics and admin API addresses can't be changed. If conf
+// is invalid, the server keeps its configuration and the error is
+// returned.
+func (s *Server) Reload(conf *Config) error {
+	old := s.config()
+	if old != nil && conf.Metrics == nil {
+		conf.Metrics = old.Metrics
+	}
+	if err := prepareConf(conf); err != nil {
+		return err
+	}
+	if err := s.checkProfiles(conf); err != nil {
+		return err
+	}
+	// the store may have changed
+	if err := s.quota.load(conf.Quotas.Store); err != nil {
+		return err
+	}
+	s.bandwidth.set(conf.Bandwidth)
+	s.quota.set(conf.Quotas)
+	s.conf.Store(conf)
+	conf.logger().Info("configuration reloaded")
+	return nil
+}
+
+// config returns the configuration of new sessions.
+func (s *Server) config() *Config {
+	conf, _ := s.conf.Load().(*Config)
+	return conf
+}
+
+// Run listens on the addresses of the server and serves sessions
+// until Close is called.
 func (s *Server) Run() error {
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+// Listen validates the configuration and opens the listeners of the
+// server. Connections are queued by the OS until Serve is called.
+func (s *Server) Listen() error {
 	if err := s.initConf(); err != nil {
 		return err
 	}
-	addr := net.JoinHostPort(s.IP, s.Port)
-	lis, err := net.Listen("tcp", addr)
+	_, err := s.listenAll()
+	return err
+}
+
+// Serve accepts sessions on the listeners opened by Listen until
+// Close is called, then returns ErrServerClosed.
+func (s *Server) Serve() error {
+	s.mu.Lock()
+	listeners, closed := s.listeners, s.closed
+	s.mu.Unlock()
+	if closed {
+		return ErrServerClosed
+	}
+	if listeners == nil {
+		return ErrServerNotListening
+	}
+
+	logger := s.Config.logger()
+	go s.quota.flushLoop(logger, s.done())
+	if s.Config.MetricsAddr != "" {
+		go s.serveMetrics(s.Config.MetricsAddr, s.Config.Metrics, logger)
+	}
+	if s.Config.Admin != nil {
+		go s.serveAdmin(s.Config.Admin, logger)
+	}
+
+	var wg sync.WaitGroup
+	configs := s.listenerConfigs()
+	for i, lis := range listeners {
+		logger.Info("listening", "addr", lis.Addr().String())
+		wg.Add(1)
+		go s.serve(lis, configs[i].Profile, &wg)
+	}
+	wg.Wait()
+	return ErrServerClosed
+}
+
+func (s *Server) serveConn(conn net.Conn, conf *Config) {
+	defer conn.Close()
+	sess := newSession(atomic.AddUint64(&s.lastID, 1), conn)
+	defer sess.cancel()
+	s.track(sess)
+	defer s.untrack(sess)
+	logger := conf.logger()
+	logger.Debug("session accepted", sess.logArgs()...)
+	conf.Metrics.sessionStarted()
+
+	err := s.handleConn(sess, conf)
+	if atomic.LoadInt32(&sess.closed) != 0 {
+		err = ErrSessionClosed
+	}
+	select {
+	case <-s.done():
+		// the flush loop has stopped, save the traffic of
+		// sessions draining after Close
+		s.quota.save(logger)
+	default:
+	}
+	conf.Metrics.sessionEnded(sess)
+	conf.Hooks.close(sess, err)
+	if conf.AccessLog != nil {
+		conf.AccessLog.Log(sess.accessRecord(err))
+	}
+
+	args := append(sess.logArgs(),
+		"handshake", sess.handshake,
+		"dial", sess.dial,
+		"duration", time.Since(sess.start),
+		"up", sess.stats.Upload,
+		"down", sess.stats.Download,
+	)
 	if err != nil {
-		return err
+		logger.Warn("session failed", append(args, "error", err)...)
+		return
 	}
+	logger.Debug("session closed", args...)
+}
 
-	for {
-		conn, err := lis.Accept()
+func (s *Server) handleConn(sess *session, conf *Config) error {
+	conn, start := sess.conn, sess.start
+	if timeout := conf.handshakeTimeout(); timeout > 0 {
+		conn.SetDeadline(start.Add(timeout))
+	}
+	c := newCodec(conn)
+	defer func() {
+		sess.reply, sess.replied = c.reply, c.replied
+		c.release()
+	}()
+	if sess.dst != nil {
+		// transparent clients get no SOCKS replies
+		c.w = io.Discard
+	}
+
+	if conf.ProxyProtocol != nil && sess.dst == nil && conf.ProxyProtocol.trusts(sess.client) {
+		client, err := c.readProxyHeader()
 		if err != nil {
-			log.Printf("connection failure from [%s]: %+v", conn.RemoteAddr(), err)
-			continue
+			return handshakeErr(err)
+		}
+		if client != nil {
+			sess.client = client
+			sess.publish()
 		}
+	}
+	if err := conf.Hooks.accept(sess); err != nil {
+		conf.Metrics.denial(err)
+		return err
+	}
 
-		go func() {
-			defer conn.Close()
-			err := handleConn(conn, s.Config)
-			if err != nil {
-				log.Printf("handle connection failure from [%s]: %+v", conn.RemoteAddr(), err)
-			}
-		}()
+	// limit sessions, rejecting after the handshake so the client
+	// gets a proper reply
+	limits := conf.Limits
+	limitErr := ErrSessionLimit
+	if key := (limitKey{kind: limitSessions}); s.limiter.acquire(key, limits.MaxSessions, limits.QueueTimeout) {
+		defer s.limiter.release(key)
+		limitErr = ErrClientSessionLimit
+		if key := (limitKey{limitClient, remoteIP(sess.client)}); s.limiter.acquire(key, limits.MaxSessionsPerClient, limits.QueueTimeout) {
+			defer s.limiter.release(key)
+			limitErr = nil
+		}
+	}
+	if s.Draining() {
+		limitErr = ErrServerDraining
 	}
-}
 
-func handleConn(conn net.Conn, conf *Config) error {
-	// auth
-	if err := auth(conn, conf); err != nil {
-		return err
+	// auth, skipped by transparent sessions
+	var user string
+	if sess.dst == nil {
+		var err error
+		user, err = auth(c, conf)
+		conf.Metrics.handshake(conf.AuthMethod, err == nil)
+		sess.user = user
+		sess.publish()
+		conf.Hooks.auth(sess, err)
+		if err != nil {
+			return handshakeErr(err)
+		}
+	}
+	if limitErr == nil && user != "" {
+		key := limitKey{limitUser, user}
+		if s.limiter.acquire(key, limits.MaxSessionsPerUser, limits.QueueTimeout) {
+			defer s.limiter.release(key)
+		} else {
+			limitErr = ErrUserSessionLimit
+		}
+	}
+	if limitErr != nil {
+		conf.Metrics.denial(limitErr)
+		return rejectRequest(c, sess, ReplyGeneralSOCKSServerFailure, limitErr)
+	}
+	if s.quota.exceeded(user) {
+		conf.Metrics.denial(ErrQuotaExceeded)
+		return rejectRequest(c, sess, ReplyConnectionNotAllowedByRuleset, ErrQuotaExceeded)
 	}
 
 	// request
-	target, err := request(conn)
+	target, err := request(c, conf, sess)
 	if err != nil {
+		return handshakeErr(err)
+	}
+	if target == nil {
+		// answered a RESOLVE command
+		sess.handshake = time.Since(start)
+		return nil
+	}
+	conn.SetDeadline(time.Time{})
+	sess.handshake = time.Since(start)
+	conf.logger().Debug("tunnel established", sess.logArgs()...)
+	early, err := c.flushTo(target)
+	if err != nil {
+		target.Close()
 		return err
 	}
 
 	// forward
-	return forward(conn, target)
+	t := &tunnel{
+		timeouts:  newTunnelTimeouts(conf, start),
+		bandwidth: s.bandwidth.open(user),
+		account: func(n int64, upload bool) error {
+			sess.transferred(n, upload)
+			conf.Metrics.transfer(user, upload, n)
+			return s.quota.add(user, n)
+		},
+		done: sess.ctx.Done(),
+	}
+	defer t.bandwidth.close()
+	if err := t.account(early, true); err != nil {
+		target.Close()
+		return err
+	}
+	sess.stats, err = forward(conn, target, t)
+	sess.stats.Upload += early
+	return err
 }
 
-func auth(conn io.ReadWriter, conf *Config) error {
+// rejectRequest reads the client request and denies it with reply.
+func rejectRequest(c *codec, sess *session, reply Reply, reason error) error {
+	msg, err := readRequest(c, sess)
+	if err != nil {
+		return handshakeErr(err)
+	}
+	sess.request = msg
+	sess.publish()
+	c.writeReqFailureMsg(reply)
+	return reason
+}
+
+func auth(c *codec, conf *Config) (string, error) {
 	// Read client auth message
-	msg, err := NewClientAuthMsg(conn)
+	var msg ClientAuthMsg
+	err := c.readClientAuthMsg(&msg)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// Check if the auth method is supported
 	if !msg.ContainsMethod(conf.AuthMethod) {
-		NewServerAuthMsg(conn, MethodNoAcceptable)
-		return fmt.Errorf("method %v not supported", conf.AuthMethod)
+		c.writeServerAuthMsg(MethodNoAcceptable)
+		return "", fmt.Errorf("method %v not supported", conf.AuthMethod)
 	}
 
-	err = NewServerAuthMsg(conn, conf.AuthMethod)
+	err = c.writeServerAuthMsg(conf.AuthMethod)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	switch conf.AuthMethod {
 	case MethodPassword:
-		msg, err := NewClientPasswordMsg(conn)
+		var msg ClientPasswordMsg
+		err := c.readClientPasswordMsg(&msg)
 		if err != nil {
-			return err
+			return "", err
 		}
 		if !conf.PasswordChecker(msg.Username, msg.Password) {
-			WriteSrvPasswordMsg(conn, PasswordAuthFailure)
-			return ErrPasswordAuthFailure
+			c.writeSrvPasswordMsg(PasswordAuthFailure)
+			return "", ErrPasswordAuthFailure
 		}
-		err = WriteSrvPasswordMsg(conn, PasswordAuthSuccess)
+		err = c.writeSrvPasswordMsg(PasswordAuthSuccess)
 		if err != nil {
-			return err
+			return "", err
 		}
+		return msg.Username, nil
 	case MethodNoAuth:
 		break
 	}
-	return nil
+	return "", nil
 }
 
-func request(conn io.ReadWriter) (io.ReadWriteCloser, error) {
-	msg, err := NewClientRequestMsg(conn)
+// readRequest reads the client request, or makes up the CONNECT
+// request of a transparent session.
+func readRequest(c *codec, sess *session) (*ClientRequestMsg, error) {
+	if sess.dst != nil {
+		return transparentRequest(sess.dst), nil
+	}
+	msg := new(ClientRequestMsg)
+	if err := c.readClientRequestMsg(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func request(c *codec, conf *Config, sess *session) (net.Conn, error) {
+	msg, err := readRequest(c, sess)
 	if err != nil {
 		return nil, err
 	}
+	sess.request = msg
 
 	// Check if the command is supported
-	if msg.Command != CmdConnect {
+	switch msg.Command {
+	case CmdConnect:
+	case CmdResolve, CmdResolvePTR:
+		if conf.ResolveCommands {
+			break
+		}
+		fallthrough
+	default:
 		// no supported
-		return nil, WriteReqFailureMsg(conn, ReplyCommandNotSupported)
+		c.writeReqFailureMsg(ReplyCommandNotSupported)
+		return nil, fmt.Errorf("command %v not supported", msg.Command)
 	}
 
-	// Check if the address type is supported
-	if msg.AddrType == IPv6Addr {
-		return nil, WriteReqFailureMsg(conn, ReplyAddressTypeNotSupported)
+	if err := conf.Hooks.request(sess, msg); err != nil {
+		conf.Metrics.denial(err)
+		c.writeReqFailureMsg(ReplyConnectionNotAllowedByRuleset)
+		return nil, err
+	}
+	sess.publish()
+
+	ctx, cancel := context.WithTimeout(sess.ctx, dialTimeout)
+	defer cancel()
+	if msg.Command != CmdConnect {
+		return nil, resolve(ctx, c, conf, msg)
+	}
+
+	// Resolve target address
+	addrs, err := resolveTarget(ctx, conf, msg)
+	if err != nil {
+		c.writeReqFailureMsg(ReplyHostUnreachablle)
+		return nil, err
+	}
+	outbound := conf.outbound(sess.user)
+	if addrs = outbound.filter(addrs); len(addrs) == 0 {
+		c.writeReqFailureMsg(ReplyNetworkUnreachable)
+		return nil, ErrNoOutboundAddr
 	}
 
 	// Access target tcp server
-	address := net.JoinHostPort(msg.Address, fmt.Sprintf("%d", msg.Port))
-	targetConn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	dialStart := time.Now()
+	targetConn, err := dialAddrs(ctx, outbound, addrs, msg.Port, conf.FallbackDelay)
+	sess.dial = time.Since(dialStart)
+	conf.Metrics.dial(sess.dial)
 	if err != nil {
-		return nil, WriteReqFailureMsg(conn, ReplyConnectionRefused)
+		conf.Hooks.dial(sess, err)
+		c.writeReqFailureMsg(ReplyConnectionRefused)
+		return nil, err
+	}
+
+	sess.remote = targetConn.RemoteAddr()
+	sess.publish()
+	conf.Hooks.dial(sess, nil)
+
+	if version := outbound.proxyHeader(); version != 0 {
+		header := appendProxyHeader(nil, version, sess.client, sess.remote, sess.user)
+		if _, err := targetConn.Write(header); err != nil {
+			targetConn.Close()
+			c.writeReqFailureMsg(ReplyGeneralSOCKSServerFailure)
+			return nil, err
+		}
 	}
 
 	// Send success message
 	addrVal := targetConn.LocalAddr()
 	addr := addrVal.(*net.TCPAddr)
-	return targetConn, WriteReqSuccessMsg(conn, addr.IP, uint16(addr.Port))
+	if err := c.writeReqSuccessMsg(addr.IP, uint16(addr.Port)); err != nil {
+		targetConn.Close()
+		return nil, err
+	}
+	return targetConn, nil
 }
 
-func forward(server io.ReadWriter, target io.ReadWriteCloser) error {
-	defer target.Close()
+func (s *Server) serveMetrics(addr string, metrics *Metrics, logger Logger) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	s.serveHTTP("metrics", addr, mux, logger)
+}
 
-	go io.Copy(target, server)
-	_, err := io.Copy(server, target)
-	return err
+// serveHTTP serves h on addr until the server is closed.
+func (s *Server) serveHTTP(name, addr string, h http.Handler, logger Logger) {
+	srv := &http.Server{Addr: addr, Handler: h}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.httpServers = append(s.httpServers, srv)
+	s.mu.Unlock()
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		logger.Error(name+" listener failure", "addr", addr, "error", err)
+	}
 }
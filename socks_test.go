@@ -2,6 +2,7 @@ package socks
 
 import (
 	"bytes"
+	"net"
 	"reflect"
 	"testing"
 )
@@ -54,7 +55,7 @@ func TestAuth(t *testing.T) {
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
 			buf := bytes.NewBuffer(c.data)
-			err := auth(buf, &Config{})
+			_, err := auth(newCodec(buf), &Config{})
 			if c.wantErr && err == nil {
 				t.Fatalf("expected want error but got nil")
 			}
@@ -76,7 +77,7 @@ func FuzzAuth(f *testing.F) {
 	f.Add([]byte{}, byte(0), false)
 
 	f.Fuzz(func(t *testing.T, data []byte, method byte, res bool) {
-		auth(bytes.NewBuffer(data), &Config{
+		auth(newCodec(bytes.NewBuffer(data)), &Config{
 			AuthMethod: method,
 			PasswordChecker: func(username string, password string) bool {
 				return res
@@ -85,10 +86,55 @@ func FuzzAuth(f *testing.F) {
 	})
 }
 
+// newTestSession returns a session on one end of a pipe.
+func newTestSession(t testing.TB) *session {
+	conn, peer := net.Pipe()
+	sess := newSession(1, conn)
+	t.Cleanup(func() {
+		sess.cancel()
+		conn.Close()
+		peer.Close()
+	})
+	return sess
+}
+
 func FuzzRequest(f *testing.F) {
 	f.Add([]byte{})
+	f.Add([]byte{SOCKS5Version, CmdConnect, ReservedField, IPv4Addr, 127, 0, 0, 1, 0, 1})
 
 	f.Fuzz(func(t *testing.T, data []byte) {
-		request(bytes.NewBuffer(data))
+		target, _ := request(newCodec(bytes.NewBuffer(data)), &Config{}, newTestSession(t))
+		if target != nil {
+			target.Close()
+		}
 	})
 }
+
+func TestServerReload(t *testing.T) {
+	metrics := NewMetrics()
+	s := &Server{Config: &Config{Metrics: metrics}}
+	if err := s.initConf(); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+
+	invalid := &Config{AuthMethod: MethodPassword}
+	if err := s.Reload(invalid); err != ErrPasswordCheckerNotSet {
+		t.Fatalf("expected want error %v but got %v", ErrPasswordCheckerNotSet, err)
+	}
+	if s.config() != s.Config {
+		t.Fatalf("expected invalid configuration to be refused")
+	}
+
+	conf := *testPasswordConf
+	conf.Logger = DiscardLogger
+	conf.Limits.MaxSessions = 10
+	if err := s.Reload(&conf); err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	if s.config() != &conf {
+		t.Fatalf("expected new sessions to use the reloaded configuration")
+	}
+	if conf.Metrics != metrics {
+		t.Fatalf("expected metrics to be kept across reloads")
+	}
+}
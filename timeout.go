@@ -0,0 +1,78 @@
+package socks
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const defaultHandshakeTimeout = 10 * time.Second
+
+func (c *Config) handshakeTimeout() time.Duration {
+	if c.HandshakeTimeout == 0 {
+		return defaultHandshakeTimeout
+	}
+	return c.HandshakeTimeout
+}
+
+// handshakeErr labels errors caused by the handshake deadline.
+func handshakeErr(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("%w: %v", ErrHandshakeTimeout, err)
+	}
+	return err
+}
+
+// tunnelTimeouts enforces the idle timeout and the session lifetime
+// of a tunnel. Activity in either direction keeps both directions alive.
+type tunnelTimeouts struct {
+	idle    time.Duration
+	expires time.Time
+
+	// lastActive is the unix nano time of the last transfer
+	lastActive int64
+}
+
+func newTunnelTimeouts(conf *Config, start time.Time) *tunnelTimeouts {
+	t := &tunnelTimeouts{
+		idle:       conf.IdleTimeout,
+		lastActive: time.Now().UnixNano(),
+	}
+	if conf.MaxSessionLifetime > 0 {
+		t.expires = start.Add(conf.MaxSessionLifetime)
+	}
+	return t
+}
+
+// deadline returns the read deadline of the next transfer. Transfers
+// return at least every idle/2 so that a direction moving data reports
+// its activity before the other direction checks for idleness.
+func (t *tunnelTimeouts) deadline() time.Time {
+	var deadline time.Time
+	if t.idle > 0 {
+		deadline = time.Now().Add(t.idle / 2)
+	}
+	if !t.expires.IsZero() && (deadline.IsZero() || t.expires.Before(deadline)) {
+		deadline = t.expires
+	}
+	return deadline
+}
+
+func (t *tunnelTimeouts) touch() {
+	atomic.StoreInt64(&t.lastActive, time.Now().UnixNano())
+}
+
+// expired reports why the tunnel timed out, nil if it is still alive.
+func (t *tunnelTimeouts) expired() error {
+	now := time.Now()
+	if !t.expires.IsZero() && !now.Before(t.expires) {
+		return ErrSessionLifetimeExceeded
+	}
+	last := time.Unix(0, atomic.LoadInt64(&t.lastActive))
+	if t.idle > 0 && now.Sub(last) >= t.idle {
+		return ErrIdleTimeout
+	}
+	return nil
+}
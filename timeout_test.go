@@ -0,0 +1,85 @@
+package socks
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandshakeTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// The client never sends its greeting
+	err := new(Server).handleConn(newSession(1, server), &Config{HandshakeTimeout: 50 * time.Millisecond})
+	if !errors.Is(err, ErrHandshakeTimeout) {
+		t.Fatalf("expected want error %v but got %v", ErrHandshakeTimeout, err)
+	}
+}
+
+func TestForwardTimeouts(t *testing.T) {
+	cases := []struct {
+		name    string
+		conf    Config
+		traffic bool
+		err     error
+	}{
+		{
+			name:    "idle_timeout",
+			conf:    Config{IdleTimeout: 50 * time.Millisecond},
+			traffic: false,
+			err:     ErrIdleTimeout,
+		},
+		{
+			name:    "upload_keeps_alive",
+			conf:    Config{IdleTimeout: 50 * time.Millisecond, MaxSessionLifetime: 300 * time.Millisecond},
+			traffic: true,
+			err:     ErrSessionLifetimeExceeded,
+		},
+		{
+			name:    "lifetime_exceeded",
+			conf:    Config{MaxSessionLifetime: 50 * time.Millisecond},
+			traffic: false,
+			err:     ErrSessionLifetimeExceeded,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			target, remote := net.Pipe()
+			defer remote.Close()
+
+			if c.traffic {
+				// Upload only, the download direction stays idle
+				go func() {
+					for {
+						if _, err := client.Write([]byte("ping")); err != nil {
+							return
+						}
+						time.Sleep(10 * time.Millisecond)
+					}
+				}()
+				go func() {
+					buf := make([]byte, 64)
+					for {
+						if _, err := remote.Read(buf); err != nil {
+							return
+						}
+					}
+				}()
+			}
+
+			_, err := forward(server, target, &tunnel{
+				timeouts:  newTunnelTimeouts(&c.conf, time.Now()),
+				bandwidth: new(bandwidthLimiter).open(""),
+			})
+			if !errors.Is(err, c.err) {
+				t.Fatalf("expected want error %v but got %v", c.err, err)
+			}
+		})
+	}
+}
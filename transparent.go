@@ -0,0 +1,138 @@
+package socks
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// Modes of Listener.Transparent.
+const (
+	// TransparentRedirect accepts connections of iptables REDIRECT rules.
+	TransparentRedirect = "redirect"
+	// TransparentTProxy accepts connections of iptables TPROXY rules.
+	// The listening socket needs IP_TRANSPARENT, which takes CAP_NET_ADMIN.
+	TransparentTProxy = "tproxy"
+)
+
+// transparentListener accepts connections redirected to it, along with
+// their original destination.
+type transparentListener struct {
+	*net.TCPListener
+	tproxy bool
+}
+
+// listenTransparent opens the listener of a transparent mode.
+func (l *Listener) listenTransparent() (net.Listener, error) {
+	if l.Transparent != TransparentRedirect && l.Transparent != TransparentTProxy {
+		return nil, ErrInvalidTransparentListener
+	}
+	if !transparentSupported {
+		return nil, ErrTransparentNotSupported
+	}
+	var (
+		lis net.Listener
+		err error
+	)
+	switch {
+	case l.File != nil:
+		lis, err = net.FileListener(l.File)
+	case l.Network == "unix":
+		return nil, ErrInvalidTransparentListener
+	case l.Transparent == TransparentTProxy:
+		lc := net.ListenConfig{Control: setTransparent}
+		lis, err = lc.Listen(context.Background(), l.network(), l.Address)
+	default:
+		lis, err = net.Listen(l.network(), l.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tcp, ok := lis.(*net.TCPListener)
+	if !ok {
+		lis.Close()
+		return nil, ErrInvalidTransparentListener
+	}
+	return &transparentListener{TCPListener: tcp, tproxy: l.Transparent == TransparentTProxy}, nil
+}
+
+func (l *transparentListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	dst, err := l.originalDst(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("original destination of %v: %w", conn.RemoteAddr(), err)
+	}
+	return &transparentConn{TCPConn: conn, dst: dst}, nil
+}
+
+// originalDst returns where the client of conn connected to. TPROXY
+// keeps the destination of connections, REDIRECT rewrites it.
+func (l *transparentListener) originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	dst, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, ErrNoOriginalDst
+	}
+	if !l.tproxy {
+		var err error
+		if dst, err = originalDst(conn); err != nil {
+			return nil, err
+		}
+	}
+	// Connections made to the listener itself would loop
+	if l.loops(dst) {
+		return nil, ErrNoOriginalDst
+	}
+	return dst, nil
+}
+
+// interfaceAddrs is replaced by tests.
+var interfaceAddrs = net.InterfaceAddrs
+
+// loops reports whether dst is the address of the listener, which
+// bound to a wildcard address listens on every local address.
+func (l *transparentListener) loops(dst *net.TCPAddr) bool {
+	self, ok := l.Addr().(*net.TCPAddr)
+	if !ok || dst.Port != self.Port {
+		return false
+	}
+	if !self.IP.IsUnspecified() {
+		return dst.IP.Equal(self.IP)
+	}
+	if dst.IP.IsLoopback() || dst.IP.IsUnspecified() {
+		return true
+	}
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		// Refuse rather than risk a loop
+		return true
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(dst.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// transparentConn is a connection accepted by a transparentListener.
+// newSession unwraps it, so tunnels still splice between TCP connections.
+type transparentConn struct {
+	*net.TCPConn
+	dst *net.TCPAddr
+}
+
+// transparentRequest returns the CONNECT request standing for the
+// original destination of a transparent session.
+func transparentRequest(dst *net.TCPAddr) *ClientRequestMsg {
+	msg := &ClientRequestMsg{
+		Command: CmdConnect,
+		Address: dst.IP.String(),
+		Port:    uint16(dst.Port),
+	}
+	msg.AddrType = hostAddrType(msg.Address)
+	return msg
+}
@@ -0,0 +1,133 @@
+package socks
+
+import (
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestTransparentSession(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.ReadFull(conn, make([]byte, 4))
+		conn.Write([]byte("pong"))
+	}()
+
+	client, server := tcpPair(t)
+	rec := new(hookRecorder)
+	conf := *testPasswordConf
+	conf.Hooks = rec.hooks()
+	conf.Logger = DiscardLogger
+	done := make(chan struct{})
+	go func() {
+		new(Server).serveConn(&transparentConn{TCPConn: server, dst: lis.Addr().(*net.TCPAddr)}, &conf)
+		close(done)
+	}()
+
+	// no SOCKS handshake, even with password authentication configured
+	client.Write([]byte("ping"))
+	client.CloseWrite()
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	<-done
+	if string(got) != "pong" {
+		t.Fatalf("expected tunnel to answer %q but got %q", "pong", got)
+	}
+	expect := []string{"accept", "request", "dial", "close"}
+	if !reflect.DeepEqual(rec.events, expect) {
+		t.Fatalf("expected hooks %v but got %v", expect, rec.events)
+	}
+	if rec.info.Target != lis.Addr().String() || rec.err != nil {
+		t.Fatalf("expected session to %v but got %+v and %v", lis.Addr(), rec.info, rec.err)
+	}
+}
+
+func TestTransparentListener(t *testing.T) {
+	cases := []Listener{
+		{Address: "127.0.0.1:0", Transparent: "nat"},
+		{Network: "unix", Address: "socks.sock", Transparent: TransparentRedirect},
+	}
+	for _, l := range cases {
+		if _, err := l.listen(); err != ErrInvalidTransparentListener && err != ErrTransparentNotSupported {
+			t.Fatalf("expected want error %v but got %v", ErrInvalidTransparentListener, err)
+		}
+	}
+	if !transparentSupported {
+		t.Skip("transparent proxy mode not supported")
+	}
+
+	// Listening with IP_TRANSPARENT takes CAP_NET_ADMIN, the listener
+	// of the loop test only needs its mode
+	lis, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	tl := &transparentListener{TCPListener: lis, tproxy: true}
+	defer tl.Close()
+	conn, err := net.Dial("tcp", tl.Addr().String())
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	defer conn.Close()
+	// A connection made to the listener itself is refused
+	if _, err := tl.Accept(); !errors.Is(err, ErrNoOriginalDst) {
+		t.Fatalf("expected want error %v but got %v", ErrNoOriginalDst, err)
+	}
+}
+
+func TestTransparentListenerLoops(t *testing.T) {
+	lis, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatalf("expected want nil but got error: %+v", err)
+	}
+	tl := &transparentListener{TCPListener: lis, tproxy: true}
+	defer tl.Close()
+	port := tl.Addr().(*net.TCPAddr).Port
+
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{&net.IPNet{IP: net.IPv4(192, 0, 2, 10), Mask: net.CIDRMask(24, 32)}}, nil
+	}
+	defer func() { interfaceAddrs = net.InterfaceAddrs }()
+
+	// Bound to the wildcard address, the listener is every local address
+	cases := []struct {
+		dst   *net.TCPAddr
+		loops bool
+	}{
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, true},
+		{&net.TCPAddr{IP: net.IPv4(192, 0, 2, 10), Port: port}, true},
+		{&net.TCPAddr{IP: net.IPv4(192, 0, 2, 20), Port: port}, false},
+		{&net.TCPAddr{IP: net.IPv4(192, 0, 2, 10), Port: port + 1}, false},
+	}
+	for _, c := range cases {
+		if got := tl.loops(c.dst); got != c.loops {
+			t.Fatalf("expected %v to loop %v but got %v", c.dst, c.loops, got)
+		}
+	}
+}
+
+func TestTransparentRequest(t *testing.T) {
+	cases := map[string]*ClientRequestMsg{
+		"192.0.2.1:443":     {Command: CmdConnect, AddrType: IPv4Addr, Address: "192.0.2.1", Port: 443},
+		"[2001:db8::1]:443": {Command: CmdConnect, AddrType: IPv6Addr, Address: "2001:db8::1", Port: 443},
+	}
+	for addr, expect := range cases {
+		dst, _ := net.ResolveTCPAddr("tcp", addr)
+		if got := transparentRequest(dst); *got != *expect {
+			t.Fatalf("expected request %+v but got %+v", expect, got)
+		}
+	}
+}